@@ -0,0 +1,47 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/programme-lv/runner/pkg/isolate"
+	"golang.org/x/exp/slog"
+)
+
+// runCleanup implements `runner cleanup`, which erases the boxes and meta
+// files that crashed runners left behind.
+func runCleanup(arguments []string) {
+	metaAgeArg := flag.Duration("meta-age", isolate.DefaultIsolateConfig().MetaFileMaxAge,
+		"remove meta files older than this")
+	flag.CommandLine.Parse(arguments)
+
+	config := isolateConfigFromFlags()
+	config.MetaFileMaxAge = *metaAgeArg
+	config.ReconcileOnStartup = false
+
+	isolateInstance, err := isolate.NewIsolateWithConfig(config)
+	if err != nil {
+		slog.Error("failed to create isolate", slog.String("error", err.Error()))
+		os.Exit(1)
+	}
+
+	report := isolateInstance.Reconcile()
+
+	fmt.Printf("box root: %s\n", isolateInstance.BoxRoot())
+	fmt.Printf("cleaned %d boxes\n", len(report.CleanedBoxes))
+	for _, boxId := range report.CleanedBoxes {
+		fmt.Printf("  box %d\n", boxId)
+	}
+	fmt.Printf("removed %d meta files\n", len(report.RemovedMetaFiles))
+	for _, path := range report.RemovedMetaFiles {
+		fmt.Printf("  %s\n", path)
+	}
+	if len(report.Errors) > 0 {
+		fmt.Printf("%d errors\n", len(report.Errors))
+		for _, msg := range report.Errors {
+			fmt.Printf("  %s\n", msg)
+		}
+		os.Exit(1)
+	}
+}
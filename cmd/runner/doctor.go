@@ -0,0 +1,45 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/programme-lv/runner/pkg/isolate"
+)
+
+// runDoctor implements `runner doctor`, which checks that the host can run
+// programs with isolate and reports what makes measurements unreliable.
+func runDoctor(arguments []string) {
+	flag.CommandLine.Parse(arguments)
+
+	caps := isolate.ProbeCapabilities(isolateConfigFromFlags())
+
+	version := caps.Version
+	if version == "" {
+		version = "not found"
+	}
+	fmt.Printf("isolate version: %s\n", version)
+	fmt.Printf("cgroup version: %d\n", caps.CgroupVersion)
+	fmt.Printf("box root: %s\n", caps.BoxRoot)
+	for _, check := range caps.Checks {
+		result := "ok"
+		switch {
+		case check.OK:
+		case check.Required:
+			result = "MISSING"
+		default:
+			result = "warning"
+		}
+		fmt.Printf("  %-28s %-8s %s\n", check.Name, result, strings.TrimSpace(check.Detail))
+	}
+
+	if err := caps.Err(); err != nil {
+		fmt.Printf("runs will not start: %s\n", err.Error())
+		os.Exit(1)
+	}
+	if warnings := caps.Warnings(); len(warnings) > 0 {
+		fmt.Printf("%d warnings\n", len(warnings))
+	}
+}
@@ -1,10 +1,14 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/lmittmann/tint"
@@ -12,29 +16,48 @@ import (
 	"github.com/programme-lv/runner/internal/languages"
 	"github.com/programme-lv/runner/internal/runner"
 	"github.com/programme-lv/runner/pkg/isolate"
+	"github.com/programme-lv/runner/pkg/sandbox"
+	"github.com/programme-lv/runner/pkg/sandbox/native"
 	"golang.org/x/exp/slog"
 )
 
 var (
-	timeLimitArg = flag.Int("time", 1, "time limit in seconds")
-	memLimitArg  = flag.Int("mem", 256, "memory limit in megabytes")
+	timeLimitArg = flag.Float64("time", 1, "cpu time limit of the execution in seconds, may be fractional")
+	wallLimitArg = flag.Float64("wall-time", 0, "wall time limit of the execution in seconds, three times -time by default")
+	memLimitArg  = flag.Int("mem", 256, "memory limit of the execution in megabytes")
 	langArg      = flag.String("lang", "", "language of the code file")
 	stdinPathArg = flag.String("stdin", "", "path to the file containing standard input")
 	codePathArg  = flag.String("code", "", "path to the code file")
+	isolateArg   = flag.String("isolate", "isolate", "path to the isolate binary")
+	minBoxIdArg  = flag.Int("min-box-id", 0, "smallest isolate box id the runner may use")
+	maxBoxIdArg  = flag.Int("max-box-id", 999, "largest isolate box id the runner may use")
+	lockDirArg   = flag.String("lock-dir", "", "directory with box id lock files shared by runners on the host")
+	backendArg   = flag.String("backend", "isolate", "sandbox backend, isolate or native")
+	cgroupsArg   = flag.Bool("cg", true, "run isolate with control groups, -cg=false limits memory per process")
+	reconcileArg = flag.Bool("reconcile", false, "clean up unlocked boxes in the box id range on startup, only when no one else uses isolate boxes in it")
+	keepBoxArg   = flag.Bool("keep-box", false, "leave the box in place after the run and print its path")
 )
 
 type Args struct {
 	TimeLim  float64
+	WallLim  float64
 	MemLim   int
 	Lang     string
 	Stdin    string
 	Code     string
 	Filename string
+	Backend  string
+	KeepBox  bool
+	Isolate  isolate.IsolateConfig
 }
 
 func parseArguments() Args {
 	flag.Parse()
+	return argsFromFlags()
+}
 
+// argsFromFlags builds the arguments from the parsed flags.
+func argsFromFlags() Args {
 	if *codePathArg == "" {
 		slog.Error("no code file provided")
 		os.Exit(1)
@@ -47,18 +70,70 @@ func parseArguments() Args {
 		stdin = string(readFile(*stdinPathArg))
 	}
 
+	wallLim := *wallLimitArg
+	if wallLim == 0 {
+		wallLim = 3 * *timeLimitArg
+	}
+
 	return Args{
-		TimeLim:  float64(*timeLimitArg),
+		TimeLim:  *timeLimitArg,
+		WallLim:  wallLim,
 		MemLim:   *memLimitArg,
 		Lang:     *langArg,
 		Stdin:    stdin,
 		Code:     code,
 		Filename: filename,
+		Backend:  *backendArg,
+		KeepBox:  *keepBoxArg,
+		Isolate:  isolateConfigFromFlags(),
+	}
+}
+
+func isolateConfigFromFlags() isolate.IsolateConfig {
+	config := isolate.DefaultIsolateConfig()
+	config.BinaryPath = *isolateArg
+	config.MinBoxId = *minBoxIdArg
+	config.MaxBoxId = *maxBoxIdArg
+	config.UseCgroups = *cgroupsArg
+	config.ReconcileOnStartup = *reconcileArg
+	if *lockDirArg != "" {
+		config.LockDir = *lockDirArg
+	}
+	return config
+}
+
+// executeConstraints applies the limits given on the command line to the
+// default constraints.
+func executeConstraints(args Args) *isolate.RuntimeConstraints {
+	constraints := isolate.DefaultRuntimeConstraints()
+	constraints.CpuTimeLimInSec = args.TimeLim
+	constraints.WallTimeLimInSec = args.WallLim
+	constraints.MemoryLimitInKB = args.MemLim * 1024
+	return &constraints
+}
+
+func newSandbox(args Args) (sandbox.Sandbox, error) {
+	switch args.Backend {
+	case "isolate":
+		isolate, err := isolate.NewIsolateWithConfig(args.Isolate)
+		if err != nil {
+			return nil, err
+		}
+		return sandbox.NewIsolateSandbox(isolate), nil
+	case "native":
+		config := native.DefaultConfig()
+		config.MinBoxId = args.Isolate.MinBoxId
+		config.MaxBoxId = args.Isolate.MaxBoxId
+		config.LockDir = args.Isolate.LockDir
+		return native.NewSandbox(config)
+	default:
+		return nil, fmt.Errorf("unknown sandbox backend %q", args.Backend)
 	}
 }
 
 func main() {
-	args := parseArguments()
+	// the native sandbox re-executes the runner as its init process
+	native.MaybeRunInit()
 
 	// colorful logging
 	slog.SetDefault(slog.New(
@@ -68,8 +143,22 @@ func main() {
 		}),
 	))
 
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "cleanup":
+			runCleanup(os.Args[2:])
+			return
+		case "doctor":
+			runDoctor(os.Args[2:])
+			return
+		}
+	}
+
+	args := parseArguments()
+
 	slog.Info("using arguments",
 		slog.Float64("time limit", args.TimeLim),
+		slog.Float64("wall time limit", args.WallLim),
 		slog.Int("memory limit", args.MemLim),
 		slog.String("language", args.Lang),
 		slog.String("stdin", args.Stdin),
@@ -79,7 +168,7 @@ func main() {
 	languageProvider, err := languages.NewJsonLanguageProvider("./configs/languages.json")
 	if err != nil {
 		slog.Error("failed to create language provider", slog.String("error", err.Error()))
-        return
+		return
 	}
 
 	var language languages.ProgrammingLanguage
@@ -88,7 +177,7 @@ func main() {
 		language, err = languageProvider.GetLanguage(args.Lang)
 		if err != nil {
 			slog.Error("failed to get programming language", slog.String("error", err.Error()))
-            return
+			return
 		}
 	} else if args.Filename != "" {
 		var err error
@@ -96,26 +185,49 @@ func main() {
 		language, err = languageProvider.FindByFileExtension(extension)
 		if err != nil {
 			slog.Error("failed to get programming language", slog.String("error", err.Error()))
-            return
+			return
 		}
 	} else {
 		slog.Error("no language provided")
-        return
+		return
 	}
 
 	slog.Info("found language", slog.String("language", fmt.Sprintf("%+v", language)))
 
-    gatherer := gatherers.NewSlogGatherer()
-    isolate, err := isolate.NewIsolate()
-    if err != nil {
-        slog.Error("failed to create isolate", slog.String("error", err.Error()))
-        return
-    }
+	gatherer := gatherers.NewSlogGatherer()
+	sandbox, err := newSandbox(args)
+	if err != nil {
+		slog.Error("failed to create sandbox", slog.String("backend", args.Backend),
+			slog.String("error", err.Error()))
+		return
+	}
 
-    runner := runner.NewRunner(gatherer, isolate)
-    runner.Run(args.Code, language, args.Stdin)
+	job := runner.Job{
+		Code:               args.Code,
+		Language:           language,
+		Stdin:              strings.NewReader(args.Stdin),
+		ExecuteConstraints: executeConstraints(args),
+	}
+	config := runner.DefaultRunnerConfig()
+	config.KeepBox = args.KeepBox
+	runner := runner.NewRunnerWithConfig(gatherer, sandbox, config)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	result, err := runner.Run(ctx, job)
+	if err != nil {
+		slog.Error("run failed", slog.String("error", err.Error()))
+		return
+	}
 
-    slog.Info("finished running")
+	var attrs []any
+	if result.Compilation != nil {
+		attrs = append(attrs, slog.String("compilation", string(result.Compilation.Outcome)))
+	}
+	if result.Execution != nil {
+		attrs = append(attrs, slog.String("verdict", string(result.Execution.Verdict)))
+	}
+	slog.Info("finished running", attrs...)
 }
 
 func readFile(path string) []byte {
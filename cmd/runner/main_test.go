@@ -0,0 +1,56 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/programme-lv/runner/pkg/isolate"
+)
+
+func TestExecuteConstraintsFromFlags(t *testing.T) {
+	code := filepath.Join(t.TempDir(), "main.py")
+	if err := os.WriteFile(code, []byte("print(1)"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		args []string
+		time float64
+		wall float64
+		mem  int
+	}{
+		{
+			name: "given",
+			args: []string{"-time=0.5", "-wall-time=2", "-mem=64"},
+			time: 0.5,
+			wall: 2,
+			mem:  64 * 1024,
+		},
+		{
+			name: "wall time from time",
+			args: []string{"-time=1.5", "-wall-time=0", "-mem=256"},
+			time: 1.5,
+			wall: 4.5,
+			mem:  256 * 1024,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := flag.CommandLine.Parse(append(test.args, "-code="+code)); err != nil {
+				t.Fatal(err)
+			}
+			constraints := executeConstraints(argsFromFlags())
+
+			want := isolate.DefaultRuntimeConstraints()
+			want.CpuTimeLimInSec = test.time
+			want.WallTimeLimInSec = test.wall
+			want.MemoryLimitInKB = test.mem
+			if *constraints != want {
+				t.Errorf("executeConstraints() = %+v, want %+v", *constraints, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,16 @@
+package gatherers
+
+// CompilationOutcome classifies how a compilation ended.
+type CompilationOutcome string
+
+const (
+	CompilationSucceeded CompilationOutcome = "OK"
+	// CompilationError means the compiler rejected the code.
+	CompilationError CompilationOutcome = "CE"
+	// CompilationTimedOut means the compiler exceeded its time limit.
+	CompilationTimedOut CompilationOutcome = "TO"
+	// CompilationOutOfMemory means the compiler exceeded its memory limit.
+	CompilationOutOfMemory CompilationOutcome = "ML"
+	// CompilationInternalError means the sandbox failed to compile.
+	CompilationInternalError CompilationOutcome = "XX"
+)
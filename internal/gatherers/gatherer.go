@@ -1,17 +1,37 @@
 package gatherers
 
+import "github.com/programme-lv/runner/pkg/isolate"
+
 
 type Gatherer interface {
 	// compilation
 	SetCompilationOutput(stdout string, stderr string)
 	FinishCompilationMetrics(cpuTimeSec float64, wallTimeSec float64,
 		memoryKb int64, exitCode int64)
+	// FinishWithCompilationFailure ends a run whose compilation didn't
+	// succeed, nothing is executed then.
+	FinishWithCompilationFailure(outcome CompilationOutcome)
 
 	// execution
-	AppendExecutionOutput(stdout string, stderr string)
+	AppendExecutionOutput(event OutputEvent)
+	// SetExecutionTranscript passes all output events once the program
+	// finished.
+	SetExecutionTranscript(transcript Transcript)
+	// AppendExecutionInput reports a chunk of stdin the program consumed,
+	// CloseExecutionInput that stdin ended.
+	AppendExecutionInput(stdin string)
+	CloseExecutionInput()
+	// SetExecutionVerdict classifies the finished execution, e.g. OLE when
+	// it was killed for exceeding the output limits.
+	SetExecutionVerdict(verdict isolate.Verdict)
 	FinishExecutionMetrics(cpuTimeSec float64, wallTimeSec float64,
 		memoryKb int64, exitCode int64)
 
 	// error
 	FinishWithError(err string)
+
+	// batch
+	// ForTest returns the gatherer for the execution events of a batch
+	// test, the compilation is reported to the batch's own gatherer.
+	ForTest(index int, name string) Gatherer
 }
@@ -0,0 +1,59 @@
+package gatherers
+
+import (
+	"strings"
+	"time"
+)
+
+type OutputStream string
+
+const (
+	Stdout OutputStream = "stdout"
+	Stderr OutputStream = "stderr"
+)
+
+// OutputEvent is a chunk of execution output.
+//
+// Events come in the order the runner read them, with one exception:
+// output the runner held back past the head of a stream, as it may have
+// to be cut under the output limits, is delivered after all else once
+// the stream ended, its truncation marker first. Such events keep the
+// Offset they were read at, so Offset only grows with Seq up to the first
+// of them.
+type OutputEvent struct {
+	// Seq numbers the events of a run from 1 across both streams, in the
+	// order they were delivered.
+	Seq int64
+	// Offset is how long after the process started the chunk was read,
+	// for a truncation marker or the tail after it when the tail began.
+	Offset time.Duration
+	Stream OutputStream
+	// Data holds the exact bytes the program wrote, unless Truncated.
+	Data string
+	// Truncated marks the note that stands in for output dropped over the
+	// output limits, between the head and the tail of a stream.
+	Truncated bool
+}
+
+// Transcript is every output event of a run in sequence.
+type Transcript []OutputEvent
+
+// String merges both streams the way a terminal would show them.
+func (transcript Transcript) String() string {
+	var merged strings.Builder
+	for _, event := range transcript {
+		merged.WriteString(event.Data)
+	}
+	return merged.String()
+}
+
+// Stream returns what was written to stream alone.
+func (transcript Transcript) Stream(stream OutputStream) string {
+	var data strings.Builder
+	for _, event := range transcript {
+		if event.Stream == stream {
+			data.WriteString(event.Data)
+		}
+	}
+	return data.String()
+}
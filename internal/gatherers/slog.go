@@ -1,16 +1,20 @@
 package gatherers
 
-import "golang.org/x/exp/slog"
+import (
+	"github.com/programme-lv/runner/pkg/isolate"
+	"golang.org/x/exp/slog"
+)
 
 type SlogGatherer struct {
+	logger *slog.Logger
 }
 
 func NewSlogGatherer() *SlogGatherer {
-	return &SlogGatherer{}
+	return &SlogGatherer{logger: slog.Default()}
 }
 
 func (g *SlogGatherer) SetCompilationOutput(stdout string, stderr string) {
-	slog.Info("compilation output",
+	g.logger.Info("compilation output",
 		slog.String("stdout", stdout),
 		slog.String("stderr", stderr))
 }
@@ -18,23 +22,48 @@ func (g *SlogGatherer) SetCompilationOutput(stdout string, stderr string) {
 func (g *SlogGatherer) FinishCompilationMetrics(
 	cpuTimeSec float64, wallTimeSec float64,
 	memoryKb int64, exitCode int64) {
-	slog.Info("compilation metrics",
+	g.logger.Info("compilation metrics",
 		slog.Float64("cpu_time_sec", cpuTimeSec),
 		slog.Float64("wall_time_sec", wallTimeSec),
 		slog.Int64("memory_kb", memoryKb),
 		slog.Int64("exit_code", exitCode))
 }
 
-func (g *SlogGatherer) AppendExecutionOutput(stdout string, stderr string) {
-	slog.Info("execution output",
-		slog.String("stdout", stdout),
-		slog.String("stderr", stderr))
+func (g *SlogGatherer) FinishWithCompilationFailure(outcome CompilationOutcome) {
+	g.logger.Error("compilation failed", slog.String("outcome", string(outcome)))
+}
+
+func (g *SlogGatherer) AppendExecutionOutput(event OutputEvent) {
+	g.logger.Info("execution output",
+		slog.Int64("seq", event.Seq),
+		slog.Duration("offset", event.Offset),
+		slog.String("stream", string(event.Stream)),
+		slog.Bool("truncated", event.Truncated),
+		slog.String("data", event.Data))
+}
+
+func (g *SlogGatherer) SetExecutionTranscript(transcript Transcript) {
+	g.logger.Info("execution transcript",
+		slog.Int("events", len(transcript)),
+		slog.String("output", transcript.String()))
+}
+
+func (g *SlogGatherer) AppendExecutionInput(stdin string) {
+	g.logger.Info("execution input consumed", slog.String("stdin", stdin))
+}
+
+func (g *SlogGatherer) CloseExecutionInput() {
+	g.logger.Info("execution input closed")
+}
+
+func (g *SlogGatherer) SetExecutionVerdict(verdict isolate.Verdict) {
+	g.logger.Info("execution verdict", slog.String("verdict", string(verdict)))
 }
 
 func (g *SlogGatherer) FinishExecutionMetrics(
     cpuTimeSec float64, wallTimeSec float64,
     memoryKb int64, exitCode int64) {
-    slog.Info("execution metrics",
+    g.logger.Info("execution metrics",
         slog.Float64("cpu_time_sec", cpuTimeSec),
         slog.Float64("wall_time_sec", wallTimeSec),
         slog.Int64("memory_kb", memoryKb),
@@ -42,7 +71,11 @@ func (g *SlogGatherer) FinishExecutionMetrics(
 }
 
 func (g *SlogGatherer) FinishWithError(err string) {
-    slog.Error("finished with error", slog.String("error", err))
+    g.logger.Error("finished with error", slog.String("error", err))
+}
+
+func (g *SlogGatherer) ForTest(index int, name string) Gatherer {
+	return &SlogGatherer{logger: g.logger.With(slog.Int("test", index), slog.String("test-name", name))}
 }
 
 var _ Gatherer = (*SlogGatherer)(nil)
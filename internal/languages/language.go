@@ -1,11 +1,26 @@
 package languages
 
+import "github.com/programme-lv/runner/pkg/isolate"
+
 type ProgrammingLanguage struct {
-    Id string `json:"id"`
-    FullName string `json:"full_name"`
-    CodeFilename string `json:"code_filename"`
-    CompileCmd *string `json:"compile_cmd"`
-    ExecuteCmd string `json:"execute_cmd"`
-    EnvVersionCmd string `json:"env_version_cmd"`
-    HelloWorldCode string `json:"hello_world_code"`
+	Id             string  `json:"id"`
+	FullName       string  `json:"full_name"`
+	CodeFilename   string  `json:"code_filename"`
+	CompileCmd     *string `json:"compile_cmd"`
+	ExecuteCmd     string  `json:"execute_cmd"`
+	EnvVersionCmd  string  `json:"env_version_cmd"`
+	HelloWorldCode string  `json:"hello_world_code"`
+	// Dirs are directory rules applied to every compilation and execution,
+	// e.g. to bind a toolchain installed under /opt.
+	Dirs []isolate.DirRule `json:"dirs"`
+	// Env is the environment of every compilation and execution.
+	Env isolate.Environment `json:"env"`
+}
+
+// RunOptions returns the options every command of the language runs with.
+func (language ProgrammingLanguage) RunOptions() *isolate.RunOptions {
+	return &isolate.RunOptions{
+		Dirs: language.Dirs,
+		Env:  language.Env,
+	}
 }
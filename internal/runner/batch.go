@@ -0,0 +1,330 @@
+package runner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/programme-lv/runner/pkg/isolate"
+	"github.com/programme-lv/runner/pkg/sandbox"
+	"golang.org/x/exp/slog"
+)
+
+// Batch is a submission for Runner.RunBatch to compile once and execute
+// on every test.
+type Batch struct {
+	Code     string
+	Language Language
+	// CompileConstraints limit the compilation and ExecuteConstraints the
+	// execution of tests without their own, nil means
+	// isolate.DefaultRuntimeConstraints.
+	CompileConstraints *isolate.RuntimeConstraints
+	ExecuteConstraints *isolate.RuntimeConstraints
+	Tests              []Test
+	// StopOnFailure skips the tests left once one ends with an error or a
+	// verdict other than VerdictOK.
+	StopOnFailure bool
+	// FreshBoxes runs every test in a new box holding a copy of the
+	// compiled box's files, so that nothing a test leaves behind is seen
+	// by the next one. Otherwise all tests run in the compiled box.
+	FreshBoxes bool
+	// Parallel is how many tests may run at once, each in a box of its own
+	// holding a copy of the compiled files, capped by the runner's
+	// MaxParallelTests. Zero or one runs the tests one after another.
+	Parallel int
+}
+
+// Test is an input a batch is executed on.
+type Test struct {
+	// Name tells the test apart in logs and the gatherer.
+	Name string
+	// Stdin is the program's input, nil means none.
+	Stdin io.Reader
+	// Constraints override the batch's ExecuteConstraints.
+	Constraints *isolate.RuntimeConstraints
+}
+
+// Validate checks the constraints before anything is started.
+func (batch *Batch) Validate() error {
+	job := Job{
+		CompileConstraints: batch.CompileConstraints,
+		ExecuteConstraints: batch.ExecuteConstraints,
+	}
+	if err := job.Validate(); err != nil {
+		return err
+	}
+	for i, test := range batch.Tests {
+		if test.Constraints == nil {
+			continue
+		}
+		if err := test.Constraints.ValidateRun(); err != nil {
+			return fmt.Errorf("test %d constraints: %w", i, err)
+		}
+	}
+	return nil
+}
+
+func (batch *Batch) constraints(test Test) *isolate.RuntimeConstraints {
+	if test.Constraints != nil {
+		return test.Constraints
+	}
+	return batch.ExecuteConstraints
+}
+
+type BatchResult struct {
+	// Compilation is nil when the language isn't compiled or the batch
+	// ended before the compilation.
+	Compilation *CompilationResult
+	// Tests has a result for every test of the batch, in order.
+	Tests []TestResult
+}
+
+type TestResult struct {
+	Name string
+	// Execution is nil when the test was skipped or ended with Err.
+	Execution *ExecutionResult
+	Err       error
+	// Skipped is set for tests that weren't run, as the compilation
+	// failed, an earlier test failed or the batch was cancelled.
+	Skipped bool
+}
+
+// Failed tells whether the test ended with an error or a verdict other
+// than VerdictOK.
+func (result *TestResult) Failed() bool {
+	if result.Err != nil {
+		return true
+	}
+	return result.Execution != nil && result.Execution.Verdict != isolate.VerdictOK
+}
+
+// RunBatch compiles batch once and executes it on every test. The
+// compilation is reported to the runner's gatherer and every test to the
+// gatherer ForTest returns for it. Tests are started in order, but with
+// Parallel they may finish in any; the results are in the order of the
+// tests regardless, and so are the gatherer calls: those of a test are
+// held back until the tests before it finished. A test ending with an error doesn't end the batch,
+// cancelling ctx does. A test killed for its output leaves its box wiped,
+// the tests after it get a new box with the compiled files.
+func (r *Runner) RunBatch(ctx context.Context, batch Batch) (*BatchResult, error) {
+	result := &BatchResult{Tests: make([]TestResult, len(batch.Tests))}
+	for i, test := range batch.Tests {
+		result.Tests[i] = TestResult{Name: test.Name, Skipped: true}
+	}
+	if err := batch.Validate(); err != nil {
+		return result, r.fail(r.logger, r.gatherer, PhaseSetup, "invalid batch", err)
+	}
+
+	box, compilation, err := r.prepare(ctx, batch.Code, batch.Language, batch.CompileConstraints)
+	result.Compilation = compilation
+	if box == nil {
+		return result, err
+	}
+	logger := r.logger.With(slog.Int("box", box.Id()))
+	defer r.releaseBox(logger, box)
+
+	// the compiled files, as a killed test wipes the box it ran in
+	files, err := readBoxFiles(box)
+	if err != nil {
+		return result, r.fail(logger, r.gatherer, PhaseSetup, "failed to read compiled box", err)
+	}
+
+	// fresh boxes are copied from the compiled one for every test anyway
+	boxes := []sandbox.Box{box}
+	workers := r.batchWorkers(batch)
+	for !batch.FreshBoxes && len(boxes) < workers {
+		copied, err := r.copyBox(files)
+		if err != nil {
+			logger.Warn("running fewer tests at once, failed to copy box",
+				slog.Int("boxes", len(boxes)), slog.String("error", err.Error()))
+			workers = len(boxes)
+			break
+		}
+		defer r.releaseBox(r.logger.With(slog.Int("box", copied.Id())), copied)
+		boxes = append(boxes, copied)
+	}
+	if workers > 1 {
+		logger.Info("running tests in parallel", slog.Int("workers", workers))
+	}
+
+	var mutex sync.Mutex
+	next, stopped := 0, false
+	// take hands out the tests in order until they run out or the batch stops
+	take := func() (int, bool) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if stopped || next == len(batch.Tests) || ctx.Err() != nil {
+			return 0, false
+		}
+		next++
+		return next - 1, true
+	}
+
+	ordered := newOrderedGatherers(r.gatherer)
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for worker := 0; worker < workers; worker++ {
+		go func(box sandbox.Box, cpus []int) {
+			defer wg.Done()
+			// a box replacing the one the worker started with is its own
+			initial := box
+			var boxErr error
+			defer func() {
+				if box != initial && box != nil {
+					r.releaseBox(r.logger.With(slog.Int("box", box.Id())), box)
+				}
+			}()
+			for {
+				i, ok := take()
+				if !ok {
+					return
+				}
+				gatherer := ordered.forTest(i, batch.Tests[i].Name)
+				var test TestResult
+				if boxErr != nil {
+					test = TestResult{Name: batch.Tests[i].Name}
+					test.Err = r.fail(r.logger, gatherer, PhaseSetup, "failed to replace box", boxErr)
+				} else {
+					test = r.runTest(ctx, box, gatherer, batch, i, cpus, files)
+				}
+				result.Tests[i] = test
+				ordered.finish(i)
+				if !batch.FreshBoxes && boxErr == nil && test.wipedBox() {
+					replaced := box
+					box, boxErr = r.copyBox(files)
+					if replaced != initial {
+						r.releaseBox(r.logger.With(slog.Int("box", replaced.Id())), replaced)
+					}
+					if boxErr == nil {
+						logger.Info("replaced box of killed test", slog.Int("test", i),
+							slog.Int("replaced", replaced.Id()), slog.Int("replacement", box.Id()))
+					}
+				}
+				if batch.StopOnFailure && test.Failed() {
+					mutex.Lock()
+					stopped = true
+					mutex.Unlock()
+					logger.Info("stopping batch on failed test", slog.Int("test", i))
+				}
+			}
+		}(boxes[worker%len(boxes)], r.workerCpus(worker))
+	}
+	wg.Wait()
+
+	if ctx.Err() != nil {
+		return result, r.fail(logger, r.gatherer, PhaseExecute, "batch cancelled", ErrCancelled)
+	}
+	return result, nil
+}
+
+// batchWorkers is how many tests of batch may run at once.
+func (r *Runner) batchWorkers(batch Batch) int {
+	workers := batch.Parallel
+	if workers > r.config.MaxParallelTests {
+		workers = r.config.MaxParallelTests
+	}
+	if len(r.config.PinCpus) > 0 && workers > len(r.config.PinCpus) {
+		workers = len(r.config.PinCpus)
+	}
+	if workers > len(batch.Tests) {
+		workers = len(batch.Tests)
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	return workers
+}
+
+// workerCpus returns the CPU the given worker of a batch is pinned to, if
+// any.
+func (r *Runner) workerCpus(worker int) []int {
+	if len(r.config.PinCpus) == 0 {
+		return nil
+	}
+	return []int{r.config.PinCpus[worker%len(r.config.PinCpus)]}
+}
+
+// runTest executes the test with the given index in box, or in a fresh
+// box with the compiled files when the batch asks for one, pinned to cpus.
+func (r *Runner) runTest(ctx context.Context, box sandbox.Box, gatherer Gatherer, batch Batch,
+	index int, cpus []int, files []boxFile) TestResult {
+	test := batch.Tests[index]
+	result := TestResult{Name: test.Name}
+
+	if batch.FreshBoxes {
+		fresh, err := r.copyBox(files)
+		if err != nil {
+			result.Err = r.fail(r.logger, gatherer, PhaseSetup, "failed to copy box", err)
+			return result
+		}
+		box = fresh
+		defer r.releaseBox(r.logger.With(slog.Int("box", box.Id())), box)
+	}
+
+	logger := r.logger.With(slog.Int("box", box.Id()),
+		slog.Int("test", index), slog.String("test-name", test.Name))
+	options := runOptions(batch.Language, batch.constraints(test))
+	options.Cpus = cpus
+	result.Execution, result.Err = r.runExecution(ctx, logger, gatherer, box,
+		batch.Language, test.Stdin, options)
+	return result
+}
+
+// wipedBox tells whether the test's process was killed. Isolate cleans
+// up the box of a killed process, nothing can run in it afterwards.
+func (result *TestResult) wipedBox() bool {
+	if errors.Is(result.Err, ErrCancelled) {
+		return true
+	}
+	if result.Execution == nil {
+		return false
+	}
+	metrics := result.Execution.Metrics
+	return metrics.Cancelled || metrics.OutputLimitExceeded
+}
+
+// boxFile is a regular file read from a box.
+type boxFile struct {
+	path    string
+	content []byte
+	mode    os.FileMode
+}
+
+// readBoxFiles reads the regular files in box, e.g. the executable it
+// compiled.
+func readBoxFiles(box sandbox.Box) ([]boxFile, error) {
+	listed, err := box.ListFiles()
+	if err != nil {
+		return nil, err
+	}
+	var files []boxFile
+	for _, file := range listed {
+		if !file.Mode.IsRegular() {
+			continue
+		}
+		content, err := box.ReadFile(file.Path)
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %w", file.Path, err)
+		}
+		files = append(files, boxFile{path: file.Path, content: content, mode: file.Mode.Perm()})
+	}
+	return files, nil
+}
+
+// copyBox creates a box holding files.
+func (r *Runner) copyBox(files []boxFile) (sandbox.Box, error) {
+	copied, err := r.sandbox.NewBox()
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		if err := copied.AddFileWithMode(file.path, file.content, file.mode); err != nil {
+			r.releaseBox(r.logger.With(slog.Int("box", copied.Id())), copied)
+			return nil, fmt.Errorf("copying %s: %w", file.path, err)
+		}
+	}
+	return copied, nil
+}
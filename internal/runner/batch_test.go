@@ -0,0 +1,121 @@
+package runner
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/programme-lv/runner/pkg/isolate"
+	"github.com/programme-lv/runner/pkg/sandbox/fake"
+)
+
+func TestRunBatchReplacesKilledBox(t *testing.T) {
+	sandbox := fake.NewSandbox()
+	var mutex sync.Mutex
+	executions := 0
+	sandbox.Script = func(call fake.Call) *fake.Result {
+		if call.Command == compileCmd {
+			return &fake.Result{Files: map[string][]byte{"main": []byte("#!/bin/sh\necho ok\n")}}
+		}
+		mutex.Lock()
+		defer mutex.Unlock()
+		executions++
+		// the first test is killed for its output, the rest run on the host
+		if executions == 1 {
+			return &fake.Result{Stdout: strings.Repeat("x", 100), Duration: time.Minute}
+		}
+		return nil
+	}
+	config := DefaultRunnerConfig()
+	config.OutputLimits = OutputLimits{Stdout: 10}
+	runner := NewRunnerWithConfig(newRecordingGatherer(), sandbox, config)
+
+	result, err := runner.RunBatch(context.Background(), Batch{
+		Code:     "int main() {}",
+		Language: compiledLanguage(),
+		Tests:    []Test{{Name: "loud"}, {Name: "after"}, {Name: "last"}},
+	})
+	if err != nil {
+		t.Fatalf("RunBatch() error = %v", err)
+	}
+
+	wantVerdicts := []isolate.Verdict{isolate.VerdictOLE, isolate.VerdictOK, isolate.VerdictOK}
+	for i, test := range result.Tests {
+		if test.Err != nil || test.Execution == nil {
+			t.Fatalf("test %d: error = %v, execution = %+v", i, test.Err, test.Execution)
+		}
+		if test.Execution.Verdict != wantVerdicts[i] {
+			t.Errorf("test %d: verdict = %s, want %s", i, test.Execution.Verdict, wantVerdicts[i])
+		}
+	}
+	if stdout := result.Tests[1].Execution.Stdout; stdout != "ok\n" {
+		t.Errorf("stdout after the killed test = %q, want %q", stdout, "ok\n")
+	}
+
+	calls := sandbox.Calls()
+	if len(calls) != 4 {
+		t.Fatalf("got %d calls, want a compilation and 3 executions", len(calls))
+	}
+	if calls[2].BoxId == calls[1].BoxId {
+		t.Errorf("the test after the killed one ran in its box %d", calls[1].BoxId)
+	}
+	if calls[3].BoxId != calls[2].BoxId {
+		t.Errorf("the last test ran in box %d, want the replacement %d", calls[3].BoxId, calls[2].BoxId)
+	}
+	if open := sandbox.OpenBoxes(); open != 0 {
+		t.Errorf("%d boxes left open", open)
+	}
+}
+
+func TestRunBatchGathersInOrder(t *testing.T) {
+	slow := isolate.DefaultRuntimeConstraints()
+	slow.CpuTimeLimInSec = 5
+	sandbox := fake.NewSandbox()
+	sandbox.Script = func(call fake.Call) *fake.Result {
+		if call.Command == compileCmd {
+			return &fake.Result{Files: map[string][]byte{"main": nil}}
+		}
+		// the first test to start, test 0, is the last to finish; it's told
+		// apart by its constraints
+		if call.Options.Constraints == &slow {
+			return &fake.Result{Stdout: "slow", Duration: 200 * time.Millisecond}
+		}
+		return &fake.Result{Stdout: "fast"}
+	}
+	config := DefaultRunnerConfig()
+	config.FlushInterval = 0
+	config.MaxParallelTests = 2
+	gatherer := newRecordingGatherer()
+	runner := NewRunnerWithConfig(gatherer, sandbox, config)
+
+	result, err := runner.RunBatch(context.Background(), Batch{
+		Code:     "int main() {}",
+		Language: compiledLanguage(),
+		Tests:    []Test{{Name: "slow", Constraints: &slow}, {Name: "fast"}},
+		Parallel: 2,
+	})
+	if err != nil {
+		t.Fatalf("RunBatch() error = %v", err)
+	}
+	for i, want := range []string{"slow", "fast"} {
+		if stdout := result.Tests[i].Execution.Stdout; stdout != want {
+			t.Errorf("test %d: stdout = %q, want %q", i, stdout, want)
+		}
+	}
+
+	var want []string
+	for i := 0; i < 2; i++ {
+		want = append(want, fmt.Sprintf("%d ForTest", i))
+		for _, call := range calls([]string{"CloseExecutionInput", "AppendExecutionOutput",
+			"SetExecutionTranscript", "SetExecutionVerdict OK", "FinishExecutionMetrics"}) {
+			want = append(want, fmt.Sprintf("%d %s", i, call))
+		}
+	}
+	if trail := gatherer.Trail(); !reflect.DeepEqual(trail, want) {
+		t.Errorf("gatherer calls = %q, want %q", trail, want)
+	}
+}
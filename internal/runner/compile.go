@@ -0,0 +1,100 @@
+package runner
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	"github.com/programme-lv/runner/internal/gatherers"
+	"github.com/programme-lv/runner/pkg/isolate"
+	"github.com/programme-lv/runner/pkg/sandbox"
+)
+
+type CompilationOutcome = gatherers.CompilationOutcome
+
+// maxCompilationOutput caps how much of each compiler stream is kept, the
+// rest is read and dropped.
+const maxCompilationOutput = 1 << 20
+
+// compilation is the outcome of a language's compile command.
+type compilation struct {
+	Stdout  []byte
+	Stderr  []byte
+	Metrics *isolate.IsolateMetrics
+}
+
+// Outcome classifies the compilation by its verdict. A compiler exiting
+// with an error or dying on a signal rejected the code, its output tells
+// why.
+func (c *compilation) Outcome() CompilationOutcome {
+	switch c.Metrics.Verdict() {
+	case isolate.VerdictOK:
+		return gatherers.CompilationSucceeded
+	case isolate.VerdictRE, isolate.VerdictSG:
+		return gatherers.CompilationError
+	case isolate.VerdictTO:
+		return gatherers.CompilationTimedOut
+	case isolate.VerdictML:
+		return gatherers.CompilationOutOfMemory
+	default:
+		return gatherers.CompilationInternalError
+	}
+}
+
+// result returns the compilation as the runner reports it.
+func (c *compilation) result() *CompilationResult {
+	return &CompilationResult{
+		Outcome: c.Outcome(),
+		Stdout:  string(c.Stdout),
+		Stderr:  string(c.Stderr),
+		Metrics: c.Metrics,
+	}
+}
+
+// compile runs the compile command of language in box, which must already
+// hold the code file, limited by constraints. The caller must check
+// language.CompileCmd.
+func compile(ctx context.Context, box sandbox.Box, language Language,
+	constraints *isolate.RuntimeConstraints) (*compilation, error) {
+	process, err := box.Run(ctx, *language.CompileCmd, nil, runOptions(language, constraints))
+	if err != nil {
+		return nil, err
+	}
+
+	// both streams are drained at once so that neither fills its pipe
+	result := &compilation{}
+	var stdoutErr, stderrErr error
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		result.Stdout, stdoutErr = readLimited(process.Stdout(), maxCompilationOutput)
+	}()
+	go func() {
+		defer wg.Done()
+		result.Stderr, stderrErr = readLimited(process.Stderr(), maxCompilationOutput)
+	}()
+	wg.Wait()
+
+	result.Metrics, err = process.Wait()
+	if err != nil {
+		return nil, err
+	}
+	if stdoutErr != nil {
+		return nil, stdoutErr
+	}
+	if stderrErr != nil {
+		return nil, stderrErr
+	}
+	return result, nil
+}
+
+// readLimited reads reader to the end and returns the first limit bytes.
+func readLimited(reader io.Reader, limit int64) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(reader, limit))
+	if err != nil {
+		return data, err
+	}
+	_, err = io.Copy(io.Discard, reader)
+	return data, err
+}
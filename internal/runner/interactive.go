@@ -0,0 +1,276 @@
+package runner
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/programme-lv/runner/internal/gatherers"
+	"github.com/programme-lv/runner/pkg/isolate"
+	"github.com/programme-lv/runner/pkg/sandbox"
+	"golang.org/x/exp/slog"
+)
+
+// maxTranscriptBytes caps how much of the conversation is recorded, the
+// processes keep talking past it.
+const maxTranscriptBytes = 1 << 20
+
+// maxInteractiveStderr caps how much of each side's stderr is kept.
+const maxInteractiveStderr = 1 << 20
+
+// InteractiveProgram is one side of an interactive run.
+type InteractiveProgram struct {
+	Code     string
+	Language Language
+	// CompileConstraints limit the compilation and Constraints the
+	// execution, nil means the defaults.
+	CompileConstraints *isolate.RuntimeConstraints
+	Constraints        *isolate.RuntimeConstraints
+	// Files are added to the box before compilation, e.g. the test the
+	// interactor plays out.
+	Files map[string][]byte
+}
+
+// Party tells which side of an interactive run wrote a transcript entry.
+type Party string
+
+const (
+	PartyProgram    Party = "program"
+	PartyInteractor Party = "interactor"
+)
+
+// TranscriptEntry is a chunk of data one side sent to the other, in the
+// order it passed through the runner.
+type TranscriptEntry struct {
+	From Party
+	Data string
+}
+
+// InteractiveResult combines the outcome of both processes.
+type InteractiveResult struct {
+	// ProgramCompilation and InteractorCompilation are nil for a side
+	// whose language isn't compiled or that wasn't compiled, as the
+	// program's compilation failed first.
+	ProgramCompilation    *CompilationResult
+	InteractorCompilation *CompilationResult
+
+	// Verdict is the program's verdict unless the program ran fine, then
+	// it's the interactor's: an interactor exiting with an error usually
+	// rejected the program's answers, its stderr tells. It's empty when a
+	// compilation failed, nothing was run then, or the run failed.
+	Verdict    isolate.Verdict
+	Program    *isolate.IsolateMetrics
+	Interactor *isolate.IsolateMetrics
+
+	// ProgramStderr and InteractorStderr are cut at maxInteractiveStderr
+	// bytes, the Truncated fields tell when they were.
+	ProgramStderr             string
+	ProgramStderrTruncated    bool
+	InteractorStderr          string
+	InteractorStderrTruncated bool
+
+	Transcript          []TranscriptEntry
+	TranscriptTruncated bool
+}
+
+// RunInteractive compiles program and interactor in separate boxes and
+// runs them with each one's stdout fed to the other one's stdin. A side
+// that doesn't compile isn't an error, the result's compilations tell.
+// Other failures, including cancellation through ctx, end the run with a
+// *RunError, the result then holds what the run got to.
+func (r *Runner) RunInteractive(ctx context.Context,
+	program InteractiveProgram, interactor InteractiveProgram) (*InteractiveResult, error) {
+	result := &InteractiveResult{}
+	programBox, compilation, err := r.prepareInteractive(ctx, program, PartyProgram)
+	result.ProgramCompilation = compilation
+	if programBox == nil {
+		return result, err
+	}
+	defer r.releaseBox(r.logger.With(slog.Int("box", programBox.Id())), programBox)
+
+	interactorBox, compilation, err := r.prepareInteractive(ctx, interactor, PartyInteractor)
+	result.InteractorCompilation = compilation
+	if interactorBox == nil {
+		return result, err
+	}
+	defer r.releaseBox(r.logger.With(slog.Int("box", interactorBox.Id())), interactorBox)
+
+	logger := r.logger.With(slog.Int("program-box", programBox.Id()),
+		slog.Int("interactor-box", interactorBox.Id()))
+	logger.Info("running interactive program")
+
+	toProgram, fromInteractor := io.Pipe()
+	toInteractor, fromProgram := io.Pipe()
+
+	programProcess, err := programBox.Run(ctx, program.Language.ExecuteCmd,
+		toProgram, runOptions(program.Language, program.Constraints))
+	if err != nil {
+		return result, logRunError(logger, PhaseExecute, "failed to start program", err)
+	}
+	interactorProcess, err := interactorBox.Run(ctx, interactor.Language.ExecuteCmd,
+		toInteractor, runOptions(interactor.Language, interactor.Constraints))
+	if err != nil {
+		programProcess.Kill()
+		fromProgram.Close()
+		result.Program, _ = programProcess.Wait()
+		return result, logRunError(logger, PhaseExecute, "failed to start interactor", err)
+	}
+
+	transcript := &transcript{}
+	var programErr, interactorErr error
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		result.ProgramStderr, result.ProgramStderrTruncated =
+			relay(fromProgram, programProcess, transcript.writer(PartyProgram))
+		result.Program, programErr = programProcess.Wait()
+	}()
+	go func() {
+		defer wg.Done()
+		result.InteractorStderr, result.InteractorStderrTruncated =
+			relay(fromInteractor, interactorProcess, transcript.writer(PartyInteractor))
+		result.Interactor, interactorErr = interactorProcess.Wait()
+	}()
+	wg.Wait()
+	result.Transcript, result.TranscriptTruncated = transcript.entries()
+
+	if programErr != nil {
+		return result, logRunError(logger, PhaseExecute, "failed to run program", programErr)
+	}
+	if interactorErr != nil {
+		return result, logRunError(logger, PhaseExecute, "failed to run interactor", interactorErr)
+	}
+	if result.Program.Cancelled || result.Interactor.Cancelled {
+		return result, logRunError(logger, PhaseExecute, "interactive run cancelled", ErrCancelled)
+	}
+
+	result.Verdict = result.Program.Verdict()
+	if result.Verdict == isolate.VerdictOK {
+		result.Verdict = result.Interactor.Verdict()
+	}
+
+	logger.Info("finished interactive program",
+		slog.String("verdict", string(result.Verdict)),
+		slog.String("program-verdict", string(result.Program.Verdict())),
+		slog.String("interactor-verdict", string(result.Interactor.Verdict())),
+		slog.Int("transcript-entries", len(result.Transcript)))
+	return result, nil
+}
+
+// prepareInteractive creates a box with the code and files of program and
+// compiles it. The box is nil when program can't be run, with an error or
+// a compilation that failed.
+func (r *Runner) prepareInteractive(ctx context.Context,
+	program InteractiveProgram, party Party) (sandbox.Box, *CompilationResult, error) {
+	logger := r.logger.With(slog.String("party", string(party)))
+	box, err := r.sandbox.NewBox()
+	if err != nil {
+		return nil, nil, logRunError(logger, PhaseSetup, "failed to create "+string(party)+" box", err)
+	}
+	logger = logger.With(slog.Int("box", box.Id()))
+
+	err = box.AddFile(program.Language.CodeFilename, []byte(program.Code))
+	for path, content := range program.Files {
+		if err != nil {
+			break
+		}
+		err = box.AddFile(path, content)
+	}
+	if err != nil {
+		r.releaseBox(logger, box)
+		return nil, nil, logRunError(logger, PhaseSetup, "failed to add "+string(party)+" files to box", err)
+	}
+
+	if program.Language.CompileCmd == nil {
+		return box, nil, nil
+	}
+	compiled, err := compile(ctx, box, program.Language, program.CompileConstraints)
+	if err != nil {
+		r.releaseBox(logger, box)
+		return nil, nil, logRunError(logger, PhaseCompile, "failed to compile "+string(party), err)
+	}
+	if compiled.Metrics.Cancelled {
+		r.releaseBox(logger, box)
+		return nil, nil, logRunError(logger, PhaseCompile, string(party)+" compilation cancelled", ErrCancelled)
+	}
+
+	result := compiled.result()
+	switch result.Outcome {
+	case gatherers.CompilationSucceeded:
+		return box, result, nil
+	case gatherers.CompilationInternalError:
+		err = logRunError(logger, PhaseCompile, "failed to compile "+string(party),
+			fmt.Errorf("outcome %s: %s", result.Outcome, compiled.Stderr))
+	default:
+		logger.Info("interactive compilation failed", slog.String("outcome", string(result.Outcome)))
+	}
+	r.releaseBox(logger, box)
+	return nil, result, err
+}
+
+// relay copies the stdout of process into the stdin of the other side,
+// recording it on the way, and returns the stderr of process along with
+// whether it was truncated. The stdin is closed once the output ends so
+// that the other side sees EOF.
+func relay(stdin *io.PipeWriter, process sandbox.Process, record io.Writer) (string, bool) {
+	var stderr []byte
+	done := make(chan struct{})
+	go func() {
+		// one byte more tells whether there was more
+		stderr, _ = readLimited(process.Stderr(), maxInteractiveStderr+1)
+		close(done)
+	}()
+
+	_, err := io.Copy(stdin, io.TeeReader(process.Stdout(), record))
+	stdin.CloseWithError(err)
+	// the other side may have quit early, the rest is still recorded
+	io.Copy(record, process.Stdout())
+
+	<-done
+	if len(stderr) > maxInteractiveStderr {
+		return string(stderr[:maxInteractiveStderr]), true
+	}
+	return string(stderr), false
+}
+
+// transcript records what the sides of an interactive run send each other.
+type transcript struct {
+	mutex     sync.Mutex
+	list      []TranscriptEntry
+	size      int
+	truncated bool
+}
+
+func (t *transcript) writer(from Party) io.Writer {
+	return transcriptWriter{transcript: t, from: from}
+}
+
+func (t *transcript) entries() ([]TranscriptEntry, bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.list, t.truncated
+}
+
+type transcriptWriter struct {
+	transcript *transcript
+	from       Party
+}
+
+func (w transcriptWriter) Write(data []byte) (int, error) {
+	t := w.transcript
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	chunk := data
+	if t.size+len(chunk) > maxTranscriptBytes {
+		chunk = chunk[:maxTranscriptBytes-t.size]
+		t.truncated = true
+	}
+	if len(chunk) > 0 {
+		t.list = append(t.list, TranscriptEntry{From: w.from, Data: string(chunk)})
+		t.size += len(chunk)
+	}
+	return len(data), nil
+}
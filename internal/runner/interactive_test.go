@@ -0,0 +1,301 @@
+package runner
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/programme-lv/runner/internal/gatherers"
+	"github.com/programme-lv/runner/pkg/isolate"
+	"github.com/programme-lv/runner/pkg/sandbox/fake"
+)
+
+func TestRunInteractiveCompilationFailure(t *testing.T) {
+	tests := []struct {
+		name string
+		// failing is the code whose compilation fails with metrics
+		failing    string
+		metrics    isolate.IsolateMetrics
+		program    CompilationOutcome
+		interactor CompilationOutcome
+		wantErr    bool
+	}{
+		{
+			name:    "program compilation error",
+			failing: "program",
+			metrics: isolate.IsolateMetrics{Status: "RE", ExitCode: 1},
+			program: gatherers.CompilationError,
+		},
+		{
+			name:    "program compilation timed out",
+			failing: "program",
+			metrics: isolate.IsolateMetrics{Status: "TO"},
+			program: gatherers.CompilationTimedOut,
+		},
+		{
+			name:       "interactor out of memory",
+			failing:    "interactor",
+			metrics:    isolate.IsolateMetrics{CgEnabled: true, CgOomKilled: true},
+			program:    gatherers.CompilationSucceeded,
+			interactor: gatherers.CompilationOutOfMemory,
+		},
+		{
+			name:    "program compilation internal error",
+			failing: "program",
+			metrics: isolate.IsolateMetrics{Status: "XX"},
+			program: gatherers.CompilationInternalError,
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sandbox := fake.NewSandbox()
+			codes := make(map[int]string)
+			sandbox.Script = func(call fake.Call) *fake.Result {
+				if codes[call.BoxId] == test.failing {
+					return &fake.Result{Stderr: "error", Metrics: &test.metrics}
+				}
+				return &fake.Result{Files: map[string][]byte{"main": nil}}
+			}
+			// the fake numbers boxes in order, the program's comes first
+			codes[0], codes[1] = "program", "interactor"
+			runner := NewRunner(newRecordingGatherer(), sandbox)
+
+			result, err := runner.RunInteractive(context.Background(),
+				InteractiveProgram{Code: "program", Language: compiledLanguage()},
+				InteractiveProgram{Code: "interactor", Language: compiledLanguage()})
+			if (err != nil) != test.wantErr {
+				t.Fatalf("RunInteractive() error = %v, want error %v", err, test.wantErr)
+			}
+			if got := compilationOutcome(result.ProgramCompilation); got != test.program {
+				t.Errorf("program compilation = %q, want %q", got, test.program)
+			}
+			if got := compilationOutcome(result.InteractorCompilation); got != test.interactor {
+				t.Errorf("interactor compilation = %q, want %q", got, test.interactor)
+			}
+			if result.Verdict != "" {
+				t.Errorf("verdict = %s, want none", result.Verdict)
+			}
+			if open := sandbox.OpenBoxes(); open != 0 {
+				t.Errorf("%d boxes left open", open)
+			}
+		})
+	}
+}
+
+func compilationOutcome(result *CompilationResult) CompilationOutcome {
+	if result == nil {
+		return ""
+	}
+	return result.Outcome
+}
+
+// shellProgram runs code with sh on the host through the fake sandbox.
+func shellProgram(code string) InteractiveProgram {
+	language := Language{Id: "sh", CodeFilename: "main.sh", ExecuteCmd: "sh main.sh"}
+	return InteractiveProgram{Code: code, Language: language}
+}
+
+// adder is an interactor that asks for a sum and checks the answer.
+const adder = `echo 2 3
+read answer
+if [ "$answer" = 5 ]; then echo accepted >&2; else echo rejected >&2; exit 1; fi`
+
+func TestRunInteractive(t *testing.T) {
+	tests := []struct {
+		name             string
+		program          string
+		interactor       string
+		verdict          isolate.Verdict
+		transcript       []TranscriptEntry
+		interactorStderr string
+	}{
+		{
+			name:       "accepted",
+			program:    "read a b; echo $((a + b))",
+			interactor: adder,
+			verdict:    isolate.VerdictOK,
+			transcript: []TranscriptEntry{
+				{From: PartyInteractor, Data: "2 3\n"},
+				{From: PartyProgram, Data: "5\n"},
+			},
+			interactorStderr: "accepted\n",
+		},
+		{
+			name:       "rejected by the interactor",
+			program:    "read a b; echo $((a * b))",
+			interactor: adder,
+			verdict:    isolate.VerdictRE,
+			transcript: []TranscriptEntry{
+				{From: PartyInteractor, Data: "2 3\n"},
+				{From: PartyProgram, Data: "6\n"},
+			},
+			interactorStderr: "rejected\n",
+		},
+		{
+			// the program's verdict wins over the interactor's
+			name:       "program fails",
+			program:    "read a b; exit 3",
+			interactor: adder,
+			verdict:    isolate.VerdictRE,
+			transcript: []TranscriptEntry{
+				{From: PartyInteractor, Data: "2 3\n"},
+			},
+			interactorStderr: "rejected\n",
+		},
+		{
+			// the program sees EOF once the interactor is gone
+			name:       "interactor quits first",
+			program:    "cat; echo done",
+			interactor: "echo hello",
+			verdict:    isolate.VerdictOK,
+			transcript: []TranscriptEntry{
+				{From: PartyInteractor, Data: "hello\n"},
+				{From: PartyProgram, Data: "hello\ndone\n"},
+			},
+		},
+		{
+			// and the interactor once the program is gone
+			name:       "program quits first",
+			program:    "echo bye",
+			interactor: "cat; echo done >&2",
+			verdict:    isolate.VerdictOK,
+			transcript: []TranscriptEntry{
+				{From: PartyProgram, Data: "bye\n"},
+				{From: PartyInteractor, Data: "bye\n"},
+			},
+			interactorStderr: "done\n",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sandbox := fake.NewSandbox()
+			runner := NewRunner(newRecordingGatherer(), sandbox)
+
+			result, err := runner.RunInteractive(context.Background(),
+				shellProgram(test.program), shellProgram(test.interactor))
+			if err != nil {
+				t.Fatalf("RunInteractive() error = %v", err)
+			}
+			if result.Verdict != test.verdict {
+				t.Errorf("verdict = %s, want %s", result.Verdict, test.verdict)
+			}
+			if got := mergeTranscript(result.Transcript); !reflect.DeepEqual(got, test.transcript) {
+				t.Errorf("transcript = %q, want %q", got, test.transcript)
+			}
+			if result.TranscriptTruncated {
+				t.Errorf("transcript truncated")
+			}
+			if result.InteractorStderr != test.interactorStderr {
+				t.Errorf("interactor stderr = %q, want %q", result.InteractorStderr, test.interactorStderr)
+			}
+			if open := sandbox.OpenBoxes(); open != 0 {
+				t.Errorf("%d boxes left open", open)
+			}
+		})
+	}
+}
+
+// mergeTranscript joins consecutive entries of a side, how the data is
+// split depends on how the pipes were read.
+func mergeTranscript(entries []TranscriptEntry) []TranscriptEntry {
+	var merged []TranscriptEntry
+	for _, entry := range entries {
+		if last := len(merged) - 1; last >= 0 && merged[last].From == entry.From {
+			merged[last].Data += entry.Data
+			continue
+		}
+		merged = append(merged, entry)
+	}
+	return merged
+}
+
+func TestRunInteractiveTruncation(t *testing.T) {
+	sandbox := fake.NewSandbox()
+	runner := NewRunner(newRecordingGatherer(), sandbox)
+
+	// more than both limits, the interactor reads it all regardless
+	program := "head -c 1100000 /dev/zero; head -c 1100000 /dev/zero >&2"
+	result, err := runner.RunInteractive(context.Background(),
+		shellProgram(program), shellProgram("cat > /dev/null"))
+	if err != nil {
+		t.Fatalf("RunInteractive() error = %v", err)
+	}
+	if result.Verdict != isolate.VerdictOK {
+		t.Errorf("verdict = %s, want OK", result.Verdict)
+	}
+
+	size := 0
+	for _, entry := range result.Transcript {
+		if entry.From != PartyProgram {
+			t.Errorf("transcript entry from %s, want only the program's", entry.From)
+		}
+		size += len(entry.Data)
+	}
+	if size != maxTranscriptBytes || !result.TranscriptTruncated {
+		t.Errorf("transcript of %d bytes, truncated %v, want %d bytes truncated",
+			size, result.TranscriptTruncated, maxTranscriptBytes)
+	}
+	if len(result.ProgramStderr) != maxInteractiveStderr || !result.ProgramStderrTruncated {
+		t.Errorf("program stderr of %d bytes, truncated %v, want %d bytes truncated",
+			len(result.ProgramStderr), result.ProgramStderrTruncated, maxInteractiveStderr)
+	}
+	if result.InteractorStderrTruncated {
+		t.Errorf("empty interactor stderr truncated")
+	}
+}
+
+func TestRunInteractiveCancelled(t *testing.T) {
+	sandbox := fake.NewSandbox()
+	runner := NewRunner(newRecordingGatherer(), sandbox)
+
+	// both wait for the other to speak first
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	result, err := runner.RunInteractive(ctx, shellProgram("read line"), shellProgram("read line"))
+	if !errors.Is(err, ErrCancelled) {
+		t.Fatalf("RunInteractive() error = %v, want ErrCancelled", err)
+	}
+	var runErr *RunError
+	if !errors.As(err, &runErr) || runErr.Phase != PhaseExecute {
+		t.Errorf("RunInteractive() error = %#v, want a RunError of the execution", err)
+	}
+	if result == nil || result.Program == nil || result.Interactor == nil {
+		t.Fatalf("result = %+v, want the metrics of both sides", result)
+	}
+	if result.Verdict != "" {
+		t.Errorf("verdict = %s, want none", result.Verdict)
+	}
+	if open := sandbox.OpenBoxes(); open != 0 {
+		t.Errorf("%d boxes left open", open)
+	}
+}
+
+func TestRunInteractiveStartFailure(t *testing.T) {
+	sandbox := fake.NewSandbox()
+	startErr := errors.New("no such interactor")
+	sandbox.Script = func(call fake.Call) *fake.Result {
+		if strings.Contains(call.Command, "interactor") {
+			return &fake.Result{StartErr: startErr}
+		}
+		return nil
+	}
+	runner := NewRunner(newRecordingGatherer(), sandbox)
+
+	interactor := shellProgram("")
+	interactor.Language.ExecuteCmd = "./interactor"
+	result, err := runner.RunInteractive(context.Background(), shellProgram("cat"), interactor)
+	var runErr *RunError
+	if !errors.As(err, &runErr) || !errors.Is(err, startErr) {
+		t.Fatalf("RunInteractive() error = %v, want a RunError wrapping %v", err, startErr)
+	}
+	if result == nil || result.Program == nil {
+		t.Fatalf("result = %+v, want the program's metrics", result)
+	}
+	if open := sandbox.OpenBoxes(); open != 0 {
+		t.Errorf("%d boxes left open", open)
+	}
+}
@@ -0,0 +1,46 @@
+package runner
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/programme-lv/runner/pkg/isolate"
+)
+
+// Job is a submission for Runner.Run to compile and execute.
+type Job struct {
+	Code     string
+	Language Language
+	// Stdin is the program's input, nil means none. It may stay open while
+	// the program runs, e.g. the read end of an io.Pipe fed as a user types
+	// or a ChannelReader.
+	Stdin io.Reader
+	// CompileConstraints limit the compilation and ExecuteConstraints the
+	// execution, nil means isolate.DefaultRuntimeConstraints. Neither may
+	// carry a disk quota, the box is created before either applies.
+	CompileConstraints *isolate.RuntimeConstraints
+	ExecuteConstraints *isolate.RuntimeConstraints
+}
+
+// Validate checks the constraints before anything is started.
+func (job *Job) Validate() error {
+	if job.CompileConstraints != nil {
+		if err := job.CompileConstraints.ValidateRun(); err != nil {
+			return fmt.Errorf("compile constraints: %w", err)
+		}
+	}
+	if job.ExecuteConstraints != nil {
+		if err := job.ExecuteConstraints.ValidateRun(); err != nil {
+			return fmt.Errorf("execute constraints: %w", err)
+		}
+	}
+	return nil
+}
+
+// runOptions returns the options of a language's command limited by
+// constraints.
+func runOptions(language Language, constraints *isolate.RuntimeConstraints) *isolate.RunOptions {
+	options := language.RunOptions()
+	options.Constraints = constraints
+	return options
+}
@@ -0,0 +1,157 @@
+package runner
+
+import (
+	"sync"
+
+	"github.com/programme-lv/runner/internal/gatherers"
+	"github.com/programme-lv/runner/pkg/isolate"
+)
+
+// orderedGatherers hand the calls of parallel batch tests to the gatherers
+// ForTest returns in the order of the tests. The first test not finished
+// yet reports as it goes; the calls of the tests after it are buffered and
+// passed on once it finished. Each test has a lock of its own, so a slow
+// gatherer only holds up the worker of the test it's reporting.
+type orderedGatherers struct {
+	gatherer Gatherer
+
+	// mutex guards the order of the tests and is taken before the lock
+	// of a test.
+	mutex sync.Mutex
+	// tests holds the started tests from next on
+	tests map[int]*orderedGatherer
+	next  int
+}
+
+func newOrderedGatherers(gatherer Gatherer) *orderedGatherers {
+	return &orderedGatherers{gatherer: gatherer, tests: make(map[int]*orderedGatherer)}
+}
+
+// forTest returns the gatherer of the test with the given index, which is
+// started.
+func (o *orderedGatherers) forTest(index int, name string) Gatherer {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	test := &orderedGatherer{ordered: o, index: index, name: name}
+	o.tests[index] = test
+	o.advanceLocked()
+	return test
+}
+
+// finish marks the test with the given index finished, its gatherer isn't
+// called anymore.
+func (o *orderedGatherers) finish(index int) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.tests[index].finished = true
+	o.advanceLocked()
+}
+
+// advanceLocked passes on the buffered calls of the tests that are next in
+// order, up to the first one that isn't finished.
+func (o *orderedGatherers) advanceLocked() {
+	for {
+		test := o.tests[o.next]
+		if test == nil {
+			return
+		}
+		if test.target == nil {
+			test.start(o.gatherer.ForTest(test.index, test.name))
+		}
+		if !test.finished {
+			return
+		}
+		delete(o.tests, o.next)
+		o.next++
+	}
+}
+
+// orderedGatherer is the gatherer of a test of orderedGatherers. Its
+// target is set once the tests before it finished, calls until then are
+// pending.
+type orderedGatherer struct {
+	ordered *orderedGatherers
+	index   int
+	name    string
+	// finished is guarded by the mutex of ordered
+	finished bool
+
+	// mutex guards pending and target, which is also only set with the
+	// mutex of ordered held
+	mutex   sync.Mutex
+	target  Gatherer
+	pending []func(Gatherer)
+}
+
+// start passes on the pending calls to target and the later ones as they
+// come.
+func (g *orderedGatherer) start(target Gatherer) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.target = target
+	for _, call := range g.pending {
+		call(target)
+	}
+	g.pending = nil
+}
+
+func (g *orderedGatherer) call(call func(Gatherer)) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if g.target != nil {
+		call(g.target)
+		return
+	}
+	g.pending = append(g.pending, call)
+}
+
+func (g *orderedGatherer) SetCompilationOutput(stdout string, stderr string) {
+	g.call(func(target Gatherer) { target.SetCompilationOutput(stdout, stderr) })
+}
+
+func (g *orderedGatherer) FinishCompilationMetrics(cpuTimeSec float64, wallTimeSec float64,
+	memoryKb int64, exitCode int64) {
+	g.call(func(target Gatherer) {
+		target.FinishCompilationMetrics(cpuTimeSec, wallTimeSec, memoryKb, exitCode)
+	})
+}
+
+func (g *orderedGatherer) FinishWithCompilationFailure(outcome CompilationOutcome) {
+	g.call(func(target Gatherer) { target.FinishWithCompilationFailure(outcome) })
+}
+
+func (g *orderedGatherer) AppendExecutionOutput(event gatherers.OutputEvent) {
+	g.call(func(target Gatherer) { target.AppendExecutionOutput(event) })
+}
+
+func (g *orderedGatherer) SetExecutionTranscript(transcript gatherers.Transcript) {
+	g.call(func(target Gatherer) { target.SetExecutionTranscript(transcript) })
+}
+
+func (g *orderedGatherer) AppendExecutionInput(stdin string) {
+	g.call(func(target Gatherer) { target.AppendExecutionInput(stdin) })
+}
+
+func (g *orderedGatherer) CloseExecutionInput() {
+	g.call(func(target Gatherer) { target.CloseExecutionInput() })
+}
+
+func (g *orderedGatherer) SetExecutionVerdict(verdict isolate.Verdict) {
+	g.call(func(target Gatherer) { target.SetExecutionVerdict(verdict) })
+}
+
+func (g *orderedGatherer) FinishExecutionMetrics(cpuTimeSec float64, wallTimeSec float64,
+	memoryKb int64, exitCode int64) {
+	g.call(func(target Gatherer) {
+		target.FinishExecutionMetrics(cpuTimeSec, wallTimeSec, memoryKb, exitCode)
+	})
+}
+
+func (g *orderedGatherer) FinishWithError(err string) {
+	g.call(func(target Gatherer) { target.FinishWithError(err) })
+}
+
+// ForTest isn't meant for a test's gatherer, it's the batch gatherer's.
+func (g *orderedGatherer) ForTest(index int, name string) Gatherer {
+	return g.ordered.gatherer.ForTest(index, name)
+}
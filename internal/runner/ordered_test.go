@@ -0,0 +1,82 @@
+package runner
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/programme-lv/runner/internal/gatherers"
+)
+
+// blockingGatherer is a batch gatherer whose first test's gatherer holds
+// up output until released.
+type blockingGatherer struct {
+	*recordingGatherer
+	release chan struct{}
+	blocked chan struct{}
+}
+
+func (g *blockingGatherer) ForTest(index int, name string) Gatherer {
+	test := g.recordingGatherer.ForTest(index, name)
+	if index == 0 {
+		return &slowGatherer{Gatherer: test, batch: g}
+	}
+	return test
+}
+
+type slowGatherer struct {
+	Gatherer
+	batch *blockingGatherer
+}
+
+func (g *slowGatherer) AppendExecutionOutput(event gatherers.OutputEvent) {
+	close(g.batch.blocked)
+	<-g.batch.release
+	g.Gatherer.AppendExecutionOutput(event)
+}
+
+func TestOrderedGathererSlowHead(t *testing.T) {
+	batch := &blockingGatherer{recordingGatherer: newRecordingGatherer(),
+		release: make(chan struct{}), blocked: make(chan struct{})}
+	ordered := newOrderedGatherers(batch)
+	first := ordered.forTest(0, "first")
+	second := ordered.forTest(1, "second")
+
+	firstDone := make(chan struct{})
+	go func() {
+		first.AppendExecutionOutput(gatherers.OutputEvent{Seq: 1})
+		close(firstDone)
+	}()
+	<-batch.blocked
+
+	// the second test buffers its calls while the first one's gatherer is busy
+	secondDone := make(chan struct{})
+	go func() {
+		second.AppendExecutionOutput(gatherers.OutputEvent{Seq: 1})
+		second.SetExecutionVerdict("OK")
+		close(secondDone)
+	}()
+	select {
+	case <-secondDone:
+	case <-time.After(time.Second):
+		t.Fatal("the second test's calls waited for the first test's gatherer")
+	}
+	ordered.finish(1)
+
+	close(batch.release)
+	<-firstDone
+	first.SetExecutionVerdict("OK")
+	ordered.finish(0)
+
+	want := []string{
+		"0 ForTest",
+		"0 AppendExecutionOutput",
+		"0 SetExecutionVerdict OK",
+		"1 ForTest",
+		"1 AppendExecutionOutput",
+		"1 SetExecutionVerdict OK",
+	}
+	if got := batch.Trail(); !reflect.DeepEqual(got, want) {
+		t.Errorf("trail = %q, want %q", got, want)
+	}
+}
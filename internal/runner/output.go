@@ -0,0 +1,285 @@
+package runner
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/programme-lv/runner/internal/gatherers"
+	"github.com/programme-lv/runner/pkg/sandbox"
+)
+
+// outputReadSize is how much is read from a stream at once.
+const outputReadSize = 32 * 1024
+
+// outputFlushSize flushes buffered output early once this much piled up.
+const outputFlushSize = 64 * 1024
+
+// OutputLimits cap the execution output. Zero leaves a cap out.
+type OutputLimits struct {
+	// Stdout, Stderr and Total are byte caps; exceeding one kills the
+	// program with VerdictOLE.
+	Stdout int64
+	Stderr int64
+	Total  int64
+	// Tail is how many bytes at the end of each stream are kept when a cap
+	// is hit. They replace what was dropped after the head of the output,
+	// with a marker event in between.
+	Tail int64
+}
+
+func DefaultOutputLimits() OutputLimits {
+	return OutputLimits{
+		Stdout: 8 << 20,
+		Stderr: 1 << 20,
+		Total:  8 << 20,
+		Tail:   4 << 10,
+	}
+}
+
+type outputChunk struct {
+	stream gatherers.OutputStream
+	offset time.Duration
+	data   []byte
+	marker bool
+}
+
+// outputTail holds the output of a stream past its head.
+type outputTail struct {
+	data    []byte
+	offset  time.Duration
+	dropped int64
+}
+
+// outputStreamer hands the execution output to the gatherer unchanged,
+// newlines, partial lines and binary data included. Chunks of both streams
+// become events of a single sequence in the order they were read, adjacent
+// chunks of the same stream merged. As stdout and stderr are separate
+// pipes, that order is only as exact as the runner could observe it.
+//
+// Output past a stream's head, the part that leaves room for the tail
+// under the caps, is held back. If the stream ends within the caps it's
+// delivered at the end; otherwise only its tail is, after a marker. Either
+// way it's out of read order, see gatherers.OutputEvent.
+type outputStreamer struct {
+	gatherer Gatherer
+	interval time.Duration
+	start    time.Time
+	limits   OutputLimits
+	// exceeded is called once, when the first cap is exceeded.
+	exceeded func()
+
+	mutex      sync.Mutex
+	pending    []outputChunk
+	size       int
+	seq        int64
+	transcript gatherers.Transcript
+	read       map[gatherers.OutputStream]int64
+	total      int64
+	tails      map[gatherers.OutputStream]*outputTail
+	overLimit  bool
+}
+
+// streamOutput reads stdout and stderr until both end, flushing what was
+// read to gatherer every interval, or right away when interval is zero. Event offsets
+// are measured from start. It returns once everything is delivered, with
+// the transcript of all events and whether a cap was exceeded.
+// A cap exceeded kills process, its output is still read to the end.
+func (r *Runner) streamOutput(gatherer Gatherer, start time.Time, process sandbox.Process) (gatherers.Transcript, bool) {
+	s := newOutputStreamer(gatherer, r.config.FlushInterval, start, r.config.OutputLimits, process.Kill)
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go s.readStream(process.Stdout(), gatherers.Stdout, &wg)
+	go s.readStream(process.Stderr(), gatherers.Stderr, &wg)
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	if s.interval > 0 {
+		ticker := time.NewTicker(s.interval)
+		defer ticker.Stop()
+	loop:
+		for {
+			select {
+			case <-ticker.C:
+				s.flush()
+			case <-done:
+				break loop
+			}
+		}
+	}
+	<-done
+	return s.finish()
+}
+
+func newOutputStreamer(gatherer Gatherer, interval time.Duration, start time.Time,
+	limits OutputLimits, exceeded func()) *outputStreamer {
+	return &outputStreamer{
+		gatherer: gatherer,
+		interval: interval,
+		start:    start,
+		limits:   limits,
+		exceeded: exceeded,
+		read:     make(map[gatherers.OutputStream]int64),
+		tails:    make(map[gatherers.OutputStream]*outputTail),
+	}
+}
+
+// finish delivers what was held back once both streams ended.
+func (s *outputStreamer) finish() (gatherers.Transcript, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.appendTailsLocked()
+	s.flushLocked()
+	return s.transcript, s.overLimit
+}
+
+func (s *outputStreamer) readStream(reader io.Reader, stream gatherers.OutputStream, wg *sync.WaitGroup) {
+	defer wg.Done()
+	buf := make([]byte, outputReadSize)
+	for {
+		n, err := reader.Read(buf)
+		if n > 0 {
+			s.append(stream, buf[:n])
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// headLeft is how much more of stream may be passed on right away.
+func (s *outputStreamer) headLeft(stream gatherers.OutputStream) int64 {
+	left := int64(-1)
+	consider := func(limit int64, used int64) {
+		if limit <= 0 {
+			return
+		}
+		tail := s.limits.Tail
+		if tail > limit {
+			tail = limit
+		}
+		remaining := limit - tail - used
+		if remaining < 0 {
+			remaining = 0
+		}
+		if left < 0 || remaining < left {
+			left = remaining
+		}
+	}
+	consider(s.streamLimit(stream), s.read[stream])
+	consider(s.limits.Total, s.total)
+	return left
+}
+
+func (s *outputStreamer) streamLimit(stream gatherers.OutputStream) int64 {
+	if stream == gatherers.Stderr {
+		return s.limits.Stderr
+	}
+	return s.limits.Stdout
+}
+
+// append buffers data; merged chunks keep the offset of the first one.
+func (s *outputStreamer) append(stream gatherers.OutputStream, data []byte) {
+	offset := time.Since(s.start)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	head := data
+	if left := s.headLeft(stream); left >= 0 && int64(len(data)) > left {
+		head = data[:left]
+		s.appendTailLocked(stream, offset, data[left:])
+	}
+	s.read[stream] += int64(len(data))
+	s.total += int64(len(data))
+
+	if len(head) > 0 {
+		s.appendChunkLocked(outputChunk{stream: stream, offset: offset, data: head})
+	}
+
+	limit := s.streamLimit(stream)
+	if !s.overLimit && ((limit > 0 && s.read[stream] > limit) ||
+		(s.limits.Total > 0 && s.total > s.limits.Total)) {
+		s.overLimit = true
+		s.exceeded()
+	}
+
+	if s.interval <= 0 || s.size >= outputFlushSize {
+		s.flushLocked()
+	}
+}
+
+func (s *outputStreamer) appendChunkLocked(chunk outputChunk) {
+	if last := len(s.pending) - 1; last >= 0 && !chunk.marker &&
+		!s.pending[last].marker && s.pending[last].stream == chunk.stream {
+		s.pending[last].data = append(s.pending[last].data, chunk.data...)
+	} else {
+		chunk.data = append([]byte(nil), chunk.data...)
+		s.pending = append(s.pending, chunk)
+	}
+	s.size += len(chunk.data)
+}
+
+// appendTailLocked keeps the last limits.Tail bytes of a stream's output
+// past its head.
+func (s *outputStreamer) appendTailLocked(stream gatherers.OutputStream, offset time.Duration, data []byte) {
+	tail := s.tails[stream]
+	if tail == nil {
+		tail = &outputTail{offset: offset}
+		s.tails[stream] = tail
+	}
+	tail.data = append(tail.data, data...)
+	if excess := int64(len(tail.data)) - s.limits.Tail; excess > 0 {
+		tail.dropped += excess
+		tail.data = append([]byte(nil), tail.data[excess:]...)
+		tail.offset = offset
+	}
+}
+
+// appendTailsLocked passes on what was held back, marking dropped output.
+func (s *outputStreamer) appendTailsLocked() {
+	for _, stream := range []gatherers.OutputStream{gatherers.Stdout, gatherers.Stderr} {
+		tail := s.tails[stream]
+		if tail == nil {
+			continue
+		}
+		if tail.dropped > 0 {
+			marker := fmt.Sprintf("\n[... %d bytes truncated ...]\n", tail.dropped)
+			s.appendChunkLocked(outputChunk{stream: stream, offset: tail.offset,
+				data: []byte(marker), marker: true})
+		}
+		if len(tail.data) > 0 {
+			s.appendChunkLocked(outputChunk{stream: stream, offset: tail.offset, data: tail.data})
+		}
+	}
+}
+
+func (s *outputStreamer) flush() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.flushLocked()
+}
+
+// flushLocked delivers the pending chunks. The mutex stays held meanwhile
+// so that chunks can't overtake each other, which also makes a slow
+// gatherer slow down the reading.
+func (s *outputStreamer) flushLocked() {
+	for _, chunk := range s.pending {
+		s.seq++
+		event := gatherers.OutputEvent{
+			Seq:       s.seq,
+			Offset:    chunk.offset,
+			Stream:    chunk.stream,
+			Data:      string(chunk.data),
+			Truncated: chunk.marker,
+		}
+		s.transcript = append(s.transcript, event)
+		s.gatherer.AppendExecutionOutput(event)
+	}
+	s.pending = nil
+	s.size = 0
+}
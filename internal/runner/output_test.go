@@ -0,0 +1,177 @@
+package runner
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/programme-lv/runner/internal/gatherers"
+	"github.com/programme-lv/runner/pkg/sandbox/fake"
+)
+
+// eventGatherer keeps the output events it gets and when it got them.
+type eventGatherer struct {
+	*recordingGatherer
+	mutex    sync.Mutex
+	events   gatherers.Transcript
+	arrivals []time.Time
+}
+
+func newEventGatherer() *eventGatherer {
+	return &eventGatherer{recordingGatherer: newRecordingGatherer()}
+}
+
+func (g *eventGatherer) AppendExecutionOutput(event gatherers.OutputEvent) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.events = append(g.events, event)
+	g.arrivals = append(g.arrivals, time.Now())
+}
+
+func (g *eventGatherer) Events() (gatherers.Transcript, []time.Time) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	return append(gatherers.Transcript(nil), g.events...), append([]time.Time(nil), g.arrivals...)
+}
+
+// runOutput runs a program that writes stdout and stderr under the fake
+// sandbox and returns its transcript along with what the gatherer got.
+func runOutput(t *testing.T, config RunnerConfig, script func(call fake.Call) *fake.Result,
+	command string) (gatherers.Transcript, *eventGatherer) {
+	t.Helper()
+	sandbox := fake.NewSandbox()
+	sandbox.Script = script
+	gatherer := newEventGatherer()
+	runner := NewRunnerWithConfig(gatherer, sandbox, config)
+
+	language := Language{Id: "sh", CodeFilename: "main.sh", ExecuteCmd: command}
+	result, err := runner.Run(context.Background(), Job{Language: language})
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	return result.Execution.Transcript, gatherer
+}
+
+func TestStreamOutputExact(t *testing.T) {
+	tests := []struct {
+		name   string
+		stdout string
+		stderr string
+	}{
+		{name: "newlines", stdout: "a\n\nb\r\n\n", stderr: "\nwarning\n"},
+		// longer than a bufio.Scanner line and than a read
+		{name: "long line", stdout: strings.Repeat("x", 200<<10) + "\n" + strings.Repeat("y", 70<<10)},
+		{name: "trailing partial line", stdout: "1 2\n3", stderr: "no newline"},
+		{name: "binary", stdout: "\x00\x01\xff\xfe\n\x00\r", stderr: "\xc3\x28"},
+		{name: "empty"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := DefaultRunnerConfig()
+			config.FlushInterval = 0
+			script := func(call fake.Call) *fake.Result {
+				return &fake.Result{Stdout: test.stdout, Stderr: test.stderr}
+			}
+			transcript, gatherer := runOutput(t, config, script, "./main")
+
+			if got := transcript.Stream(gatherers.Stdout); got != test.stdout {
+				t.Errorf("stdout = %q, want %q", got, test.stdout)
+			}
+			if got := transcript.Stream(gatherers.Stderr); got != test.stderr {
+				t.Errorf("stderr = %q, want %q", got, test.stderr)
+			}
+			events, _ := gatherer.Events()
+			if !reflect.DeepEqual(events, transcript) {
+				t.Errorf("gatherer got %q, want the transcript %q", events, transcript)
+			}
+			for i, event := range transcript {
+				if event.Seq != int64(i+1) || event.Truncated {
+					t.Errorf("event %d = seq %d, truncated %v, want seq %d not truncated",
+						i, event.Seq, event.Truncated, i+1)
+				}
+			}
+		})
+	}
+}
+
+func TestStreamOutputInterval(t *testing.T) {
+	config := DefaultRunnerConfig()
+	config.FlushInterval = 20 * time.Millisecond
+	transcript, gatherer := runOutput(t, config, nil, "sh -c 'printf first; sleep 0.3; printf second'")
+
+	if got := transcript.String(); got != "firstsecond" {
+		t.Fatalf("output = %q, want firstsecond", got)
+	}
+	events, arrivals := gatherer.Events()
+	if len(events) != 2 || events[0].Data != "first" || events[1].Data != "second" {
+		t.Fatalf("gatherer got %q, want first and second apart", events)
+	}
+	// the first chunk was passed on while the program was sleeping
+	if gap := arrivals[1].Sub(arrivals[0]); gap < 200*time.Millisecond {
+		t.Errorf("second chunk arrived %v after the first, want the first flushed early", gap)
+	}
+	if events[1].Offset-events[0].Offset < 200*time.Millisecond {
+		t.Errorf("offsets %v and %v, want them the sleep apart", events[0].Offset, events[1].Offset)
+	}
+}
+
+func TestStreamOutputTailOrder(t *testing.T) {
+	gatherer := newEventGatherer()
+	exceeded := 0
+	limits := OutputLimits{Stdout: 100, Tail: 10}
+	s := newOutputStreamer(gatherer, 0, time.Now(), limits, func() { exceeded++ })
+
+	// the reads of a program that overflows stdout, then writes to stderr
+	s.append(gatherers.Stdout, []byte(strings.Repeat("a", 80)))
+	time.Sleep(time.Millisecond)
+	s.append(gatherers.Stdout, []byte(strings.Repeat("b", 200)))
+	time.Sleep(time.Millisecond)
+	s.append(gatherers.Stderr, []byte("err\n"))
+	transcript, overLimit := s.finish()
+
+	if !overLimit || exceeded != 1 {
+		t.Errorf("over limit %v, exceeded called %d times, want it once", overLimit, exceeded)
+	}
+	want := []struct {
+		stream    gatherers.OutputStream
+		data      string
+		truncated bool
+	}{
+		{gatherers.Stdout, strings.Repeat("a", 80), false},
+		{gatherers.Stdout, strings.Repeat("b", 10), false},
+		{gatherers.Stderr, "err\n", false},
+		{gatherers.Stdout, "\n[... 180 bytes truncated ...]\n", true},
+		{gatherers.Stdout, strings.Repeat("b", 10), false},
+	}
+	if len(transcript) != len(want) {
+		t.Fatalf("transcript = %q, want %d events", transcript, len(want))
+	}
+	for i, event := range transcript {
+		if event.Seq != int64(i+1) {
+			t.Errorf("event %d seq = %d, want %d", i, event.Seq, i+1)
+		}
+		if event.Stream != want[i].stream || event.Data != want[i].data || event.Truncated != want[i].truncated {
+			t.Errorf("event %d = %s %q truncated %v, want %s %q truncated %v", i,
+				event.Stream, event.Data, event.Truncated, want[i].stream, want[i].data, want[i].truncated)
+		}
+	}
+
+	// offsets grow with seq up to the held back tail, which keeps the
+	// offset of the read it came from
+	for i := 1; i < 3; i++ {
+		if transcript[i].Offset <= transcript[i-1].Offset {
+			t.Errorf("event %d offset %v, want it after %v", i, transcript[i].Offset, transcript[i-1].Offset)
+		}
+	}
+	for _, i := range []int{3, 4} {
+		if transcript[i].Offset != transcript[1].Offset {
+			t.Errorf("tail event %d offset %v, want that of the read %v", i, transcript[i].Offset, transcript[1].Offset)
+		}
+	}
+	if events, _ := gatherer.Events(); !reflect.DeepEqual(events, transcript) {
+		t.Errorf("gatherer got %q, want the transcript %q", events, transcript)
+	}
+}
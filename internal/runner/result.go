@@ -0,0 +1,70 @@
+package runner
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/programme-lv/runner/internal/gatherers"
+	"github.com/programme-lv/runner/pkg/isolate"
+)
+
+// RunResult is what became of a job, the gatherer is told the same as the
+// run goes.
+type RunResult struct {
+	// Compilation is nil when the language isn't compiled or the run ended
+	// before the compilation.
+	Compilation *CompilationResult
+	// Execution is nil when the program wasn't executed or the execution
+	// ended with an error.
+	Execution *ExecutionResult
+}
+
+type CompilationResult struct {
+	Outcome CompilationOutcome
+	// Stdout and Stderr are the compiler's output, each cut at
+	// maxCompilationOutput bytes.
+	Stdout string
+	Stderr string
+	// Metrics are nil when the compiler couldn't be run at all.
+	Metrics *isolate.IsolateMetrics
+}
+
+type ExecutionResult struct {
+	Verdict isolate.Verdict
+	Metrics *isolate.IsolateMetrics
+	// Stdout and Stderr are the program's output within the output limits,
+	// the transcript has it event by event.
+	Stdout     string
+	Stderr     string
+	Transcript gatherers.Transcript
+}
+
+// Phase is the part of a run an error happened in.
+type Phase string
+
+const (
+	PhaseSetup   Phase = "setup"
+	PhaseCompile Phase = "compile"
+	PhaseExecute Phase = "execute"
+)
+
+// ErrCancelled is wrapped by the RunError of a run cancelled through its
+// context.
+var ErrCancelled = errors.New("cancelled")
+
+// RunError is why a run ended early. A program or compiler that merely
+// failed isn't an error, its verdict or outcome tells.
+type RunError struct {
+	Phase Phase
+	// Message is what the gatherer got.
+	Message string
+	Err     error
+}
+
+func (e *RunError) Error() string {
+	return fmt.Sprintf("%s: %s: %v", e.Phase, e.Message, e.Err)
+}
+
+func (e *RunError) Unwrap() error {
+	return e.Err
+}
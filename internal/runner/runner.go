@@ -1,151 +1,268 @@
 package runner
 
 import (
-	"bufio"
+	"context"
+	"errors"
 	"io"
-	"strings"
-	"sync"
+	"time"
 
 	"github.com/programme-lv/runner/internal/gatherers"
 	"github.com/programme-lv/runner/internal/languages"
 	"github.com/programme-lv/runner/pkg/isolate"
+	"github.com/programme-lv/runner/pkg/sandbox"
 	"golang.org/x/exp/slog"
 )
 
 type Language = languages.ProgrammingLanguage
 type Gatherer = gatherers.Gatherer
 
+type RunnerConfig struct {
+	// FlushInterval is how often the execution output read so far is
+	// passed to the gatherer, zero passes every chunk on as it's read.
+	FlushInterval time.Duration
+	// OutputLimits cap the execution output.
+	OutputLimits OutputLimits
+	// MaxParallelTests caps how many tests of a batch run at once, each in
+	// a box of its own. Zero or one runs them one after another.
+	MaxParallelTests int
+	// PinCpus pins the boxes of parallel tests to a CPU each, in turn, so
+	// they don't compete for one. Batches then don't run more tests at
+	// once than there are CPUs listed.
+	PinCpus []int
+	// KeepBox leaves every box in place once its run is over and logs its
+	// path, to look into a failing language setup. The boxes have to be
+	// cleaned up by hand then.
+	KeepBox bool
+}
+
+func DefaultRunnerConfig() RunnerConfig {
+	return RunnerConfig{
+		FlushInterval: 50 * time.Millisecond,
+		OutputLimits:  DefaultOutputLimits(),
+	}
+}
+
 type Runner struct {
 	logger   *slog.Logger
 	gatherer Gatherer
-    isolate *isolate.Isolate
+	sandbox  sandbox.Sandbox
+	config   RunnerConfig
+}
+
+func NewRunner(gatherer Gatherer, sandbox sandbox.Sandbox) *Runner {
+	return NewRunnerWithConfig(gatherer, sandbox, DefaultRunnerConfig())
 }
 
-func NewRunner(gatherer Gatherer, isolate *isolate.Isolate) *Runner {
+func NewRunnerWithConfig(gatherer Gatherer, sandbox sandbox.Sandbox, config RunnerConfig) *Runner {
 	return &Runner{
-		logger: slog.Default(),
-        isolate: isolate,
-        gatherer: gatherer,
+		logger:   slog.Default(),
+		sandbox:  sandbox,
+		gatherer: gatherer,
+		config:   config,
 	}
 }
 
-func (r *Runner) Run(code string, language Language, stdin string) {
-    logger := r.logger
+// Run compiles and executes job. Each chunk of the job's stdin is
+// forwarded as it arrives and reported to the gatherer once consumed; the
+// end of stdin closes the program's stdin. Input left once the program
+// exits is not read or reported, though a Read already waiting on stdin
+// only returns when stdin does. Cancelling ctx kills whatever runs in the sandbox at
+// the moment.
+//
+// The result holds whatever phases got done, also when the run ended
+// early with a *RunError.
+func (r *Runner) Run(ctx context.Context, job Job) (*RunResult, error) {
+	result := &RunResult{}
+	if err := job.Validate(); err != nil {
+		return result, r.fail(r.logger, r.gatherer, PhaseSetup, "invalid job", err)
+	}
+
+	box, compilation, err := r.prepare(ctx, job.Code, job.Language, job.CompileConstraints)
+	result.Compilation = compilation
+	if box == nil {
+		return result, err
+	}
+	logger := r.logger.With(slog.Int("box", box.Id()))
+	defer r.releaseBox(logger, box)
+
+	result.Execution, err = r.runExecution(ctx, logger, r.gatherer, box,
+		job.Language, job.Stdin, runOptions(job.Language, job.ExecuteConstraints))
+	return result, err
+}
 
-	box, err := r.isolate.NewBox()
-    logger = logger.With(slog.Int("box", box.Id()))
+// prepare creates a box with the code and compiles it when the language
+// is compiled. The box is nil when the run is over, with an error or a
+// failed compilation; otherwise it's the caller's to release.
+func (r *Runner) prepare(ctx context.Context, code string, language Language,
+	constraints *isolate.RuntimeConstraints) (sandbox.Box, *CompilationResult, error) {
+	logger := r.logger
+	box, err := r.sandbox.NewBox()
+	if err != nil {
+		return nil, nil, r.fail(logger, r.gatherer, PhaseSetup, "failed to create box", err)
+	}
+	logger = logger.With(slog.Int("box", box.Id()))
 	logger.Info("created box")
+	ready := false
+	defer func() {
+		if !ready {
+			r.releaseBox(logger, box)
+		}
+	}()
 
 	err = box.AddFile(language.CodeFilename, []byte(code))
 	if err != nil {
-        logger = logger.With(slog.String("error", err.Error()))
-        errMsg := "failed to add code file to box"
-		logger.Error(errMsg)
-		r.gatherer.FinishWithError(errMsg)
-		return
+		return nil, nil, r.fail(logger, r.gatherer, PhaseSetup, "failed to add code file to box", err)
 	}
 	logger.Info("added code file to box")
 
+	var compilation *CompilationResult
 	if language.CompileCmd != nil {
-		logger.Info("compiling code")
-		stdinReader := io.NopCloser(strings.NewReader(stdin))
-		process, err := box.Run(*language.CompileCmd, stdinReader, nil)
-		if err != nil {
-            logger = logger.With(slog.String("error", err.Error()))
-            errMsg := "failed to compile code"
-            logger.Error(errMsg)
-            r.gatherer.FinishWithError(errMsg)
-			return
-		}
-        stdoutStream := process.Stdout()
-        stderrStream := process.Stderr()
-
-        stdout, err := io.ReadAll(stdoutStream)
-        if err != nil {
-            logger = logger.With(slog.String("error", err.Error()))
-            errMsg := "failed to read compilation stdout"
-            logger.Error(errMsg)
-            r.gatherer.FinishWithError(errMsg)
-            return
-        }
-
-        stderr, err := io.ReadAll(stderrStream)
-        if err != nil {
-            logger = logger.With(slog.String("error", err.Error()))
-            errMsg := "failed to read compilation stderr"
-            logger.Error(errMsg)
-            r.gatherer.FinishWithError(errMsg)
-            return
-        }
-
-        r.gatherer.SetCompilationOutput(string(stdout), string(stderr))
-
-        metrics, err := process.Wait()
-
-		if err != nil {
-            logger = logger.With(slog.String("error", err.Error()))
-            errMsg := "failed to compile code"
-            logger.Error(errMsg)
-            r.gatherer.FinishWithError(errMsg)
-			return
+		compilation, err = r.runCompilation(ctx, logger, box, language, constraints)
+		if err != nil || compilation.Outcome != gatherers.CompilationSucceeded {
+			return nil, compilation, err
 		}
+	}
+	ready = true
+	return box, compilation, nil
+}
 
-        r.gatherer.FinishCompilationMetrics(
-            metrics.TimeSec,
-            metrics.TimeWallSec,
-            metrics.CgMemKb,
-            metrics.ExitCode,
-        )
+// runCompilation compiles the code in box, reporting to the gatherer. The result
+// is set unless the compilation was cancelled.
+func (r *Runner) runCompilation(ctx context.Context, logger *slog.Logger, box sandbox.Box,
+	language Language, constraints *isolate.RuntimeConstraints) (*CompilationResult, error) {
+	logger.Info("compiling code")
+	compiled, err := compile(ctx, box, language, constraints)
+	if err != nil {
+		logger = logger.With(slog.String("error", err.Error()))
+		errMsg := "failed to compile code"
+		logger.Error(errMsg)
+		r.gatherer.FinishWithCompilationFailure(gatherers.CompilationInternalError)
+		return &CompilationResult{Outcome: gatherers.CompilationInternalError},
+			&RunError{Phase: PhaseCompile, Message: errMsg, Err: err}
 	}
 
+	r.gatherer.SetCompilationOutput(string(compiled.Stdout), string(compiled.Stderr))
+
+	metrics := compiled.Metrics
+	if metrics.Cancelled {
+		return nil, r.fail(logger, r.gatherer, PhaseCompile, "compilation cancelled", ErrCancelled)
+	}
+
+	logAccounting(logger, metrics)
+	r.gatherer.FinishCompilationMetrics(
+		metrics.TimeSec,
+		metrics.TimeWallSec,
+		metrics.MemoryKb(),
+		metrics.ExitCode,
+	)
+
+	result := compiled.result()
+	// there is nothing to execute, or only a stale executable
+	if result.Outcome != gatherers.CompilationSucceeded {
+		logger.Info("compilation failed", slog.String("outcome", string(result.Outcome)),
+			slog.String("status", metrics.Status), slog.String("message", metrics.Message))
+		r.gatherer.FinishWithCompilationFailure(result.Outcome)
+	}
+	return result, nil
+}
+
+// runExecution runs the program in box, reporting to gatherer.
+func (r *Runner) runExecution(ctx context.Context, logger *slog.Logger, gatherer Gatherer, box sandbox.Box,
+	language Language, stdin io.Reader, options *isolate.RunOptions) (*ExecutionResult, error) {
 	logger.Info("running code")
 
-	stdinReader := io.NopCloser(strings.NewReader(stdin))
-	process, err := box.Run(language.ExecuteCmd, stdinReader, nil)
+	stdinReader, stdinWriter := io.Pipe()
+	start := time.Now()
+	process, err := box.Run(ctx, language.ExecuteCmd, stdinReader, options)
 	if err != nil {
-        logger = logger.With(slog.String("error", err.Error()))
-        errMsg := "failed to run code"
-        logger.Error(errMsg)
-        r.gatherer.FinishWithError(errMsg)
-		return
+		return nil, r.fail(logger, gatherer, PhaseExecute, "failed to run code", err)
 	}
+	exited := make(chan struct{})
+	forwarded := r.forwardStdin(gatherer, stdinWriter, stdin, exited)
+	waited := false
+	defer func() {
+		// the box can't be released under a process a panic left running
+		if !waited {
+			process.Kill()
+			process.Wait()
+			close(exited)
+		}
+	}()
+
+	// the output has to be read to the end before Wait closes the pipes
+	transcript, overLimit := r.streamOutput(gatherer, start, process)
+	gatherer.SetExecutionTranscript(transcript)
 
-    stdoutStream := process.Stdout()
-    stderrStream := process.Stderr()
+	metrics, err := process.Wait()
+	waited = true
+	// the input the program took is reported before what became of it
+	close(exited)
+	<-forwarded
+	if err != nil {
+		return nil, r.fail(logger, gatherer, PhaseExecute, "failed to run code", err)
+	}
+	// the kill shows up as a cancellation, though it wasn't requested
+	metrics.OutputLimitExceeded = overLimit
+	if metrics.Cancelled && !overLimit {
+		return nil, r.fail(logger, gatherer, PhaseExecute, "execution cancelled", ErrCancelled)
+	}
+	if overLimit {
+		logger.Info("output limit exceeded")
+	}
 
-    stdoutScanner := bufio.NewScanner(stdoutStream)
-    stderrScanner := bufio.NewScanner(stderrStream)
+	logAccounting(logger, metrics)
+	gatherer.SetExecutionVerdict(metrics.Verdict())
+	gatherer.FinishExecutionMetrics(
+		metrics.TimeSec,
+		metrics.TimeWallSec,
+		metrics.MemoryKb(),
+		metrics.ExitCode,
+	)
 
-    var wg sync.WaitGroup
-    wg.Add(2)
+	return &ExecutionResult{
+		Verdict:    metrics.Verdict(),
+		Metrics:    metrics,
+		Stdout:     transcript.Stream(gatherers.Stdout),
+		Stderr:     transcript.Stream(gatherers.Stderr),
+		Transcript: transcript,
+	}, nil
+}
 
-    go func() {
-        defer wg.Done()
-        for stdoutScanner.Scan() {
-            r.gatherer.AppendExecutionOutput(stdoutScanner.Text(), "")
-        }
-    }()
+// fail reports an error that ends the run to gatherer and returns it.
+func (r *Runner) fail(logger *slog.Logger, gatherer Gatherer, phase Phase, errMsg string, err error) error {
+	runErr := logRunError(logger, phase, errMsg, err)
+	gatherer.FinishWithError(errMsg)
+	return runErr
+}
 
-    go func() {
-        defer wg.Done()
-        for stderrScanner.Scan() {
-            r.gatherer.AppendExecutionOutput("", stderrScanner.Text())
-        }
-    }()
+// logRunError logs an error that ends a run and wraps it.
+func logRunError(logger *slog.Logger, phase Phase, errMsg string, err error) *RunError {
+	if errors.Is(err, ErrCancelled) {
+		logger.Info(errMsg)
+	} else {
+		logger.With(slog.String("error", err.Error())).Error(errMsg)
+	}
+	return &RunError{Phase: phase, Message: errMsg, Err: err}
+}
 
-    metrics, err := process.Wait()
-	if err != nil {
-        logger = logger.With(slog.String("error", err.Error()))
-        errMsg := "failed to run code"
-        logger.Error(errMsg)
-        r.gatherer.FinishWithError(errMsg)
+// releaseBox closes box, or leaves it in place when the config keeps boxes.
+func (r *Runner) releaseBox(logger *slog.Logger, box sandbox.Box) {
+	if r.config.KeepBox {
+		logger.Warn("kept box", slog.String("path", box.Path()))
+		return
+	}
+	if err := box.Close(); err != nil {
+		logger.Error("failed to close box", slog.String("error", err.Error()))
 		return
 	}
+	logger.Info("closed box")
+}
 
-    r.gatherer.FinishExecutionMetrics(
-        metrics.TimeSec,
-        metrics.TimeWallSec,
-        metrics.CgMemKb,
-        metrics.ExitCode,
-    )
+// logAccounting marks metrics measured without cgroups, whose memory use
+// is the peak resident set size only.
+func logAccounting(logger *slog.Logger, metrics *isolate.IsolateMetrics) {
+	if metrics.WeakAccounting() {
+		logger.Warn("metrics use weak accounting without cgroups",
+			slog.Int64("max-rss", metrics.MaxRssKb))
+	}
 }
@@ -0,0 +1,435 @@
+package runner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/programme-lv/runner/internal/gatherers"
+	"github.com/programme-lv/runner/pkg/isolate"
+	"github.com/programme-lv/runner/pkg/sandbox/fake"
+)
+
+// recordingGatherer records the calls it gets, with the argument that
+// tells them apart where there is one. The gatherers of batch tests also
+// add theirs to the trail of the batch's gatherer, prefixed with the test
+// index.
+type recordingGatherer struct {
+	mutex sync.Mutex
+	calls []string
+	tests map[int]*recordingGatherer
+	trail []string
+
+	batch *recordingGatherer
+	index int
+}
+
+func newRecordingGatherer() *recordingGatherer {
+	return &recordingGatherer{tests: make(map[int]*recordingGatherer)}
+}
+
+func (g *recordingGatherer) record(call string) {
+	g.mutex.Lock()
+	g.calls = append(g.calls, call)
+	g.mutex.Unlock()
+	if g.batch != nil {
+		g.batch.mutex.Lock()
+		g.batch.trail = append(g.batch.trail, fmt.Sprintf("%d %s", g.index, call))
+		g.batch.mutex.Unlock()
+	}
+}
+
+// Trail returns the calls of the batch's tests, in the order they came.
+func (g *recordingGatherer) Trail() []string {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	return append([]string(nil), g.trail...)
+}
+
+func (g *recordingGatherer) Calls() []string {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	return append([]string(nil), g.calls...)
+}
+
+func (g *recordingGatherer) SetCompilationOutput(stdout string, stderr string) {
+	g.record("SetCompilationOutput")
+}
+
+func (g *recordingGatherer) FinishCompilationMetrics(cpuTimeSec float64, wallTimeSec float64,
+	memoryKb int64, exitCode int64) {
+	g.record("FinishCompilationMetrics")
+}
+
+func (g *recordingGatherer) FinishWithCompilationFailure(outcome CompilationOutcome) {
+	g.record("FinishWithCompilationFailure " + string(outcome))
+}
+
+func (g *recordingGatherer) AppendExecutionOutput(event gatherers.OutputEvent) {
+	g.record("AppendExecutionOutput")
+}
+
+func (g *recordingGatherer) SetExecutionTranscript(transcript gatherers.Transcript) {
+	g.record("SetExecutionTranscript")
+}
+
+func (g *recordingGatherer) AppendExecutionInput(stdin string) {
+	g.record("AppendExecutionInput")
+}
+
+func (g *recordingGatherer) CloseExecutionInput() {
+	g.record("CloseExecutionInput")
+}
+
+func (g *recordingGatherer) SetExecutionVerdict(verdict isolate.Verdict) {
+	g.record("SetExecutionVerdict " + string(verdict))
+}
+
+func (g *recordingGatherer) FinishExecutionMetrics(cpuTimeSec float64, wallTimeSec float64,
+	memoryKb int64, exitCode int64) {
+	g.record("FinishExecutionMetrics")
+}
+
+func (g *recordingGatherer) FinishWithError(err string) {
+	g.record("FinishWithError " + err)
+}
+
+func (g *recordingGatherer) ForTest(index int, name string) Gatherer {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	test := newRecordingGatherer()
+	test.batch, test.index = g, index
+	g.tests[index] = test
+	g.trail = append(g.trail, fmt.Sprintf("%d ForTest", index))
+	return test
+}
+
+const (
+	compileCmd = "g++ main.cpp"
+	executeCmd = "./main"
+)
+
+func compiledLanguage() Language {
+	cmd := compileCmd
+	return Language{Id: "cpp", CodeFilename: "main.cpp", CompileCmd: &cmd, ExecuteCmd: executeCmd}
+}
+
+// compiles scripts a compilation that succeeds, then execute for the
+// execution.
+func compiles(execute *fake.Result) func(call fake.Call) *fake.Result {
+	return func(call fake.Call) *fake.Result {
+		if call.Command == compileCmd {
+			return &fake.Result{Files: map[string][]byte{"main": nil}}
+		}
+		return execute
+	}
+}
+
+// failsCompilation scripts a compilation ending with metrics.
+func failsCompilation(metrics isolate.IsolateMetrics) func(call fake.Call) *fake.Result {
+	return func(call fake.Call) *fake.Result {
+		return &fake.Result{Stderr: "main.cpp:1: error", Metrics: &metrics}
+	}
+}
+
+var compiledCalls = []string{"SetCompilationOutput", "FinishCompilationMetrics"}
+
+// startedCalls are reported once a program without stdin started.
+var startedCalls = calls(compiledCalls, []string{"CloseExecutionInput"})
+
+func calls(groups ...[]string) []string {
+	var all []string
+	for _, group := range groups {
+		all = append(all, group...)
+	}
+	return all
+}
+
+func TestRun(t *testing.T) {
+	tests := []struct {
+		name      string
+		script    func(call fake.Call) *fake.Result
+		newBoxErr error
+		limits    *OutputLimits
+		timeout   time.Duration
+		// commands are those the sandbox was asked to run
+		commands []string
+		gathered []string
+		outcome  CompilationOutcome
+		verdict  isolate.Verdict
+		stdout   string
+		phase    Phase
+		cancel   bool
+	}{
+		{
+			name:     "success",
+			script:   compiles(&fake.Result{Stdout: "hello"}),
+			commands: []string{compileCmd, executeCmd},
+			gathered: calls(startedCalls, []string{"AppendExecutionOutput",
+				"SetExecutionTranscript", "SetExecutionVerdict OK", "FinishExecutionMetrics"}),
+			outcome: gatherers.CompilationSucceeded,
+			verdict: isolate.VerdictOK,
+			stdout:  "hello",
+		},
+		{
+			name:     "runtime error",
+			script:   compiles(&fake.Result{ExitCode: 1}),
+			commands: []string{compileCmd, executeCmd},
+			gathered: calls(startedCalls, []string{"SetExecutionTranscript",
+				"SetExecutionVerdict RE", "FinishExecutionMetrics"}),
+			outcome: gatherers.CompilationSucceeded,
+			verdict: isolate.VerdictRE,
+		},
+		{
+			name:     "compilation error",
+			script:   failsCompilation(isolate.IsolateMetrics{Status: "RE", ExitCode: 1}),
+			commands: []string{compileCmd},
+			gathered: calls(compiledCalls, []string{"FinishWithCompilationFailure CE"}),
+			outcome:  gatherers.CompilationError,
+		},
+		{
+			name:     "compilation timed out",
+			script:   failsCompilation(isolate.IsolateMetrics{Status: "TO"}),
+			commands: []string{compileCmd},
+			gathered: calls(compiledCalls, []string{"FinishWithCompilationFailure TO"}),
+			outcome:  gatherers.CompilationTimedOut,
+		},
+		{
+			name:     "compilation out of memory",
+			script:   failsCompilation(isolate.IsolateMetrics{CgEnabled: true, CgOomKilled: true}),
+			commands: []string{compileCmd},
+			gathered: calls(compiledCalls, []string{"FinishWithCompilationFailure ML"}),
+			outcome:  gatherers.CompilationOutOfMemory,
+		},
+		{
+			name:     "compilation internal error",
+			script:   failsCompilation(isolate.IsolateMetrics{Status: "XX"}),
+			commands: []string{compileCmd},
+			gathered: calls(compiledCalls, []string{"FinishWithCompilationFailure XX"}),
+			outcome:  gatherers.CompilationInternalError,
+		},
+		{
+			name:      "box creation fails",
+			newBoxErr: errors.New("no boxes left"),
+			gathered:  []string{"FinishWithError failed to create box"},
+			phase:     PhaseSetup,
+		},
+		{
+			name: "compiler fails to start",
+			script: func(call fake.Call) *fake.Result {
+				return &fake.Result{StartErr: errors.New("no compiler")}
+			},
+			commands: []string{compileCmd},
+			gathered: []string{"FinishWithCompilationFailure XX"},
+			outcome:  gatherers.CompilationInternalError,
+			phase:    PhaseCompile,
+		},
+		{
+			name:     "program fails to start",
+			script:   compiles(&fake.Result{StartErr: errors.New("exec format error")}),
+			commands: []string{compileCmd, executeCmd},
+			gathered: calls(compiledCalls, []string{"FinishWithError failed to run code"}),
+			outcome:  gatherers.CompilationSucceeded,
+			phase:    PhaseExecute,
+		},
+		{
+			name:     "waiting for the program fails",
+			script:   compiles(&fake.Result{WaitErr: errors.New("meta file missing")}),
+			commands: []string{compileCmd, executeCmd},
+			gathered: calls(startedCalls, []string{"SetExecutionTranscript",
+				"FinishWithError failed to run code"}),
+			outcome: gatherers.CompilationSucceeded,
+			phase:   PhaseExecute,
+		},
+		{
+			name:     "cancelled",
+			script:   compiles(&fake.Result{Duration: time.Minute}),
+			timeout:  50 * time.Millisecond,
+			commands: []string{compileCmd, executeCmd},
+			gathered: calls(startedCalls, []string{"SetExecutionTranscript",
+				"FinishWithError execution cancelled"}),
+			outcome: gatherers.CompilationSucceeded,
+			phase:   PhaseExecute,
+			cancel:  true,
+		},
+		{
+			name:     "output limit exceeded",
+			script:   compiles(&fake.Result{Stdout: strings.Repeat("x", 100), Duration: time.Minute}),
+			limits:   &OutputLimits{Stdout: 10},
+			commands: []string{compileCmd, executeCmd},
+			gathered: calls(startedCalls, []string{"AppendExecutionOutput", "AppendExecutionOutput",
+				"SetExecutionTranscript", "SetExecutionVerdict OLE", "FinishExecutionMetrics"}),
+			outcome: gatherers.CompilationSucceeded,
+			verdict: isolate.VerdictOLE,
+			stdout:  "xxxxxxxxxx\n[... 90 bytes truncated ...]\n",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sandbox := fake.NewSandbox()
+			sandbox.Script = test.script
+			sandbox.NewBoxErr = test.newBoxErr
+			config := DefaultRunnerConfig()
+			config.FlushInterval = 0
+			if test.limits != nil {
+				config.OutputLimits = *test.limits
+			}
+			gatherer := newRecordingGatherer()
+			runner := NewRunnerWithConfig(gatherer, sandbox, config)
+
+			ctx := context.Background()
+			if test.timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, test.timeout)
+				defer cancel()
+			}
+			result, err := runner.Run(ctx, Job{Code: "int main() {}", Language: compiledLanguage()})
+
+			if test.phase == "" {
+				if err != nil {
+					t.Fatalf("Run() error = %v", err)
+				}
+			} else {
+				var runErr *RunError
+				if !errors.As(err, &runErr) || runErr.Phase != test.phase {
+					t.Fatalf("Run() error = %v, want a %s RunError", err, test.phase)
+				}
+				if errors.Is(err, ErrCancelled) != test.cancel {
+					t.Errorf("Run() error = %v, cancelled %v", err, !test.cancel)
+				}
+			}
+
+			var commands []string
+			for _, call := range sandbox.Calls() {
+				commands = append(commands, call.Command)
+			}
+			if !reflect.DeepEqual(commands, test.commands) {
+				t.Errorf("commands = %q, want %q", commands, test.commands)
+			}
+			if got := gatherer.Calls(); !reflect.DeepEqual(got, test.gathered) {
+				t.Errorf("gatherer calls = %q, want %q", got, test.gathered)
+			}
+			if open := sandbox.OpenBoxes(); open != 0 {
+				t.Errorf("%d boxes left open", open)
+			}
+
+			if got := compilationOutcome(result.Compilation); got != test.outcome {
+				t.Errorf("compilation outcome = %q, want %q", got, test.outcome)
+			}
+			if test.verdict == "" {
+				if result.Execution != nil {
+					t.Errorf("execution = %+v, want none", result.Execution)
+				}
+				return
+			}
+			if result.Execution == nil {
+				t.Fatalf("no execution, want verdict %s", test.verdict)
+			}
+			if result.Execution.Verdict != test.verdict {
+				t.Errorf("verdict = %s, want %s", result.Execution.Verdict, test.verdict)
+			}
+			if result.Execution.Stdout != test.stdout {
+				t.Errorf("stdout = %q, want %q", result.Execution.Stdout, test.stdout)
+			}
+		})
+	}
+}
+
+func TestRunStdin(t *testing.T) {
+	tests := []struct {
+		name    string
+		command string
+		stdin   func() io.Reader
+		input   []string
+		stdout  string
+	}{
+		{
+			name:    "consumed",
+			command: "cat",
+			stdin:   func() io.Reader { return strings.NewReader("1 2\n") },
+			input:   []string{"AppendExecutionInput", "CloseExecutionInput"},
+			stdout:  "1 2\n",
+		},
+		{
+			// a stdin that never ends mustn't hold up the run
+			name:    "left unread",
+			command: "true",
+			stdin:   func() io.Reader { return ChannelReader(make(chan string)) },
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sandbox := fake.NewSandbox()
+			gatherer := newRecordingGatherer()
+			config := DefaultRunnerConfig()
+			config.FlushInterval = 0
+			runner := NewRunnerWithConfig(gatherer, sandbox, config)
+
+			language := Language{Id: "sh", CodeFilename: "main.sh", ExecuteCmd: test.command}
+			result, err := runner.Run(context.Background(),
+				Job{Language: language, Stdin: test.stdin()})
+			if err != nil {
+				t.Fatalf("Run() error = %v", err)
+			}
+			if result.Execution.Stdout != test.stdout {
+				t.Errorf("stdout = %q, want %q", result.Execution.Stdout, test.stdout)
+			}
+
+			// input and output may interleave, but all comes before the verdict
+			gathered := gatherer.Calls()
+			var input []string
+			for _, call := range gathered {
+				if strings.HasSuffix(call, "ExecutionInput") {
+					input = append(input, call)
+				}
+			}
+			if !reflect.DeepEqual(input, test.input) {
+				t.Errorf("input calls = %q, want %q", input, test.input)
+			}
+			end := []string{"SetExecutionVerdict OK", "FinishExecutionMetrics"}
+			if len(gathered) < 2 || !reflect.DeepEqual(gathered[len(gathered)-2:], end) {
+				t.Errorf("gatherer calls = %q, want them to end with %q", gathered, end)
+			}
+		})
+	}
+}
+
+func TestRunConstraints(t *testing.T) {
+	sandbox := fake.NewSandbox()
+	sandbox.Script = compiles(&fake.Result{})
+	runner := NewRunner(newRecordingGatherer(), sandbox)
+
+	compileLimits := isolate.DefaultRuntimeConstraints()
+	compileLimits.CpuTimeLimInSec = 10
+	compileLimits.MemoryLimitInKB = 512 * 1024
+	executeLimits := isolate.DefaultRuntimeConstraints()
+	executeLimits.CpuTimeLimInSec = 0.25
+	executeLimits.WallTimeLimInSec = 0.75
+	executeLimits.MemoryLimitInKB = 64 * 1024
+	_, err := runner.Run(context.Background(), Job{Code: "int main() {}", Language: compiledLanguage(),
+		CompileConstraints: &compileLimits, ExecuteConstraints: &executeLimits})
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+
+	runs := sandbox.Calls()
+	if len(runs) != 2 {
+		t.Fatalf("got %d calls, want the compilation and the execution", len(runs))
+	}
+	for i, want := range []isolate.RuntimeConstraints{compileLimits, executeLimits} {
+		got := runs[i].Options.Constraints
+		if got == nil || *got != want {
+			t.Errorf("%s constraints = %+v, want %+v", runs[i].Command, got, want)
+		}
+	}
+	args := strings.Join(runs[1].Options.Constraints.ToArgs(true), " ")
+	if !strings.Contains(args, "--time=0.250000") || !strings.Contains(args, "--wall-time=0.750000") {
+		t.Errorf("execution arguments %q lost the fractional time limits", args)
+	}
+}
@@ -0,0 +1,107 @@
+package runner
+
+import (
+	"io"
+)
+
+// ChannelReader turns chunks of input sent on ch into a reader for
+// Job.Stdin. Closing ch closes the program's stdin.
+func ChannelReader(ch <-chan string) io.Reader {
+	return &channelReader{ch: ch}
+}
+
+type channelReader struct {
+	ch      <-chan string
+	pending string
+}
+
+func (r *channelReader) Read(p []byte) (int, error) {
+	for r.pending == "" {
+		chunk, ok := <-r.ch
+		if !ok {
+			return 0, io.EOF
+		}
+		r.pending = chunk
+	}
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
+
+// stdinChunk is what a Read of the job's stdin returned.
+type stdinChunk struct {
+	data []byte
+	err  error
+}
+
+// forwardStdin passes stdin on to the program through w a chunk at a time
+// and reports every chunk to gatherer once the program's side has taken
+// it. It stops when stdin ends or exited is closed, nothing is reported
+// after that. The returned channel is closed once it stopped; a Read of
+// stdin may still be pending then, its chunk is dropped. A nil stdin is
+// closed and reported before forwardStdin returns.
+func (r *Runner) forwardStdin(gatherer Gatherer, w *io.PipeWriter, stdin io.Reader,
+	exited <-chan struct{}) <-chan struct{} {
+	done := make(chan struct{})
+	if stdin == nil {
+		w.Close()
+		gatherer.CloseExecutionInput()
+		close(done)
+		return done
+	}
+
+	chunks := make(chan stdinChunk)
+	go func() {
+		for {
+			buf := make([]byte, 32*1024)
+			n, err := stdin.Read(buf)
+			select {
+			case chunks <- stdinChunk{data: buf[:n], err: err}:
+			case <-exited:
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	go func() {
+		defer close(done)
+		defer w.Close()
+		for {
+			var chunk stdinChunk
+			select {
+			case chunk = <-chunks:
+			case <-exited:
+				return
+			}
+			if len(chunk.data) > 0 {
+				if _, err := w.Write(chunk.data); err != nil {
+					return
+				}
+				if isClosed(exited) {
+					return
+				}
+				gatherer.AppendExecutionInput(string(chunk.data))
+			}
+			if chunk.err != nil {
+				w.Close()
+				if !isClosed(exited) {
+					gatherer.CloseExecutionInput()
+				}
+				return
+			}
+		}
+	}()
+	return done
+}
+
+func isClosed(ch <-chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
@@ -1,6 +1,8 @@
 package isolate
 
 import (
+	"context"
+	"fmt"
 	"io"
 	"os"
 	"path/filepath"
@@ -13,6 +15,7 @@ type IsolateBox struct {
 	id      int
 	path    string
 	isolate *Isolate
+	pool    *BoxPool
 	logger  *slog.Logger
 }
 
@@ -33,35 +36,88 @@ func (box *IsolateBox) Path() string {
 	return box.path
 }
 
+// Close erases the box, or hands it back to its pool if it came from one.
 func (box *IsolateBox) Close() error {
+	if box.pool != nil {
+		return box.pool.Release(box)
+	}
 	return box.isolate.EraseBox(box.id)
 }
 
-func (box *IsolateBox) Run(
-	command string,
-	stdin io.ReadCloser,
-	constraints *RuntimeConstraints) (*IsolateProcess, error) {
-	if constraints == nil {
-		c := DefaultRuntimeConstraints()
-		constraints = &c
+// Reset removes everything the previous job left in the box directory.
+func (box *IsolateBox) Reset() error {
+	dir := box.boxDir()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
 	}
-	box.logger.Info("running command in box", slog.String("command", command),
-		slog.String("constraints", strings.Join(constraints.ToArgs(), " ")))
+	for _, entry := range entries {
+		err = os.RemoveAll(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return err
+		}
+	}
+	box.logger.Info("reset box contents")
+	return nil
+}
 
-	return box.isolate.StartCommand(box.id, command, stdin, *constraints)
+// RunOptions configure a single command run in the box.
+type RunOptions struct {
+	// Constraints default to DefaultRuntimeConstraints when nil.
+	Constraints *RuntimeConstraints
+	// Dirs are extra directory rules on top of isolate's default mounts.
+	Dirs []DirRule
+	// Env extends DefaultEnvironment.
+	Env Environment
+	// Cpus pins the command to these CPUs, none leaves it to the
+	// scheduler. The command may still move itself elsewhere, pinning
+	// keeps parallel runs from disturbing each other rather than limiting
+	// them.
+	Cpus []int
 }
 
-func (box *IsolateBox) AddFile(path string, content []byte) error {
-	box.logger.Info("adding file to box", slog.String("file-path", path))
-	path = filepath.Join(box.path, "box", path)
-	_, err := os.Create(path)
-	if err != nil {
-		return err
+// PrepareRunOptions fills in the defaults of options, which may be nil,
+// and validates the result.
+func PrepareRunOptions(options *RunOptions) (RunOptions, error) {
+	var opts RunOptions
+	if options != nil {
+		opts = *options
+	}
+	if opts.Constraints == nil {
+		c := DefaultRuntimeConstraints()
+		opts.Constraints = &c
+	}
+	if err := opts.Constraints.ValidateRun(); err != nil {
+		return opts, err
+	}
+	if err := ValidateDirRules(opts.Dirs); err != nil {
+		return opts, err
+	}
+	if err := opts.Env.Validate(); err != nil {
+		return opts, err
 	}
-	err = os.WriteFile(path, content, 0644)
+	for _, cpu := range opts.Cpus {
+		if cpu < 0 {
+			return opts, fmt.Errorf("invalid cpu %d", cpu)
+		}
+	}
+	return opts, nil
+}
+
+// Run starts command in the box. Cancelling ctx kills the command and
+// everything it started.
+func (box *IsolateBox) Run(
+	ctx context.Context,
+	command string,
+	stdin io.ReadCloser,
+	options *RunOptions) (*IsolateProcess, error) {
+	opts, err := PrepareRunOptions(options)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	box.logger.Info("added file to box", slog.String("file-path", path))
-	return nil
+	box.logger.Info("running command in box", slog.String("command", command),
+		slog.String("constraints", strings.Join(opts.Constraints.ToArgs(box.isolate.config.UseCgroups), " ")),
+		slog.Int("dir-rules", len(opts.Dirs)))
+
+	return box.isolate.StartCommand(ctx, box.id, command, stdin, opts)
 }
@@ -0,0 +1,81 @@
+package isolate
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// BoxLock is an exclusive flock on <lock dir>/box-<id>.lock, held for as
+// long as this process uses the box id. The kernel drops the lock when the
+// holder dies, so a crashed runner never blocks an id for good. The holder
+// writes its pid into the file and truncates it on a clean release, which
+// lets the next owner tell that the box was abandoned. The native sandbox
+// claims its box ids the same way.
+type BoxLock struct {
+	file *os.File
+}
+
+func boxLockPath(lockDir string, boxId int) string {
+	return filepath.Join(lockDir, fmt.Sprintf("box-%d.lock", boxId))
+}
+
+// TryLockBoxId claims boxId without blocking. It returns a nil lock if
+// another process holds the id. stalePid is the pid of a previous owner
+// that exited without releasing the id, or 0.
+func TryLockBoxId(lockDir string, boxId int) (lock *BoxLock, stalePid int, err error) {
+	err = os.MkdirAll(lockDir, 0755)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	file, err := os.OpenFile(boxLockPath(lockDir, boxId), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		file.Close()
+		return nil, 0, nil
+	}
+	if err != nil {
+		file.Close()
+		return nil, 0, err
+	}
+
+	content, err := io.ReadAll(file)
+	if err != nil {
+		file.Close()
+		return nil, 0, err
+	}
+	if owner := strings.TrimSpace(string(content)); owner != "" {
+		stalePid, _ = strconv.Atoi(owner)
+	}
+
+	err = file.Truncate(0)
+	if err == nil {
+		_, err = file.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	}
+	if err != nil {
+		file.Close()
+		return nil, 0, err
+	}
+
+	return &BoxLock{file: file}, stalePid, nil
+}
+
+// Release gives up the box id.
+func (lock *BoxLock) Release() error {
+	err := lock.file.Truncate(0)
+	closeErr := lock.file.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
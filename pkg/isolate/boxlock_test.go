@@ -0,0 +1,77 @@
+package isolate
+
+import (
+	"os"
+	"os/exec"
+	"strconv"
+	"testing"
+)
+
+func TestTryLockBoxIdExclusive(t *testing.T) {
+	dir := t.TempDir()
+	lock, stalePid, err := TryLockBoxId(dir, 7)
+	if err != nil || lock == nil {
+		t.Fatalf("TryLockBoxId() = %v, %v, want the lock", lock, err)
+	}
+	if stalePid != 0 {
+		t.Errorf("stale pid of a new lock = %d, want 0", stalePid)
+	}
+
+	// flock locks belong to the open file, a second one conflicts
+	again, _, err := TryLockBoxId(dir, 7)
+	if err != nil || again != nil {
+		t.Fatalf("TryLockBoxId() of a held id = %v, %v, want no lock", again, err)
+	}
+	other, _, err := TryLockBoxId(dir, 8)
+	if err != nil || other == nil {
+		t.Fatalf("TryLockBoxId() of another id = %v, %v, want the lock", other, err)
+	}
+	other.Release()
+
+	if err := lock.Release(); err != nil {
+		t.Fatal(err)
+	}
+	if content, _ := os.ReadFile(boxLockPath(dir, 7)); len(content) != 0 {
+		t.Errorf("released lock file holds %q, want it empty", content)
+	}
+	lock, stalePid, err = TryLockBoxId(dir, 7)
+	if err != nil || lock == nil {
+		t.Fatalf("TryLockBoxId() after release = %v, %v, want the lock", lock, err)
+	}
+	if stalePid != 0 {
+		t.Errorf("stale pid after a clean release = %d, want 0", stalePid)
+	}
+	lock.Release()
+}
+
+func TestTryLockBoxIdStalePid(t *testing.T) {
+	cmd := exec.Command("true")
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	deadPid := cmd.Process.Pid
+
+	// a runner that died holding the id left its pid, padded to be longer
+	// than ours
+	dir := t.TempDir()
+	content := strconv.Itoa(deadPid) + "\n                    \n"
+	if err := os.WriteFile(boxLockPath(dir, 3), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	lock, stalePid, err := TryLockBoxId(dir, 3)
+	if err != nil || lock == nil {
+		t.Fatalf("TryLockBoxId() = %v, %v, want the lock", lock, err)
+	}
+	defer lock.Release()
+	if stalePid != deadPid {
+		t.Errorf("stale pid = %d, want %d", stalePid, deadPid)
+	}
+	got, err := os.ReadFile(boxLockPath(dir, 3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := strconv.Itoa(os.Getpid()) + "\n"; string(got) != want {
+		t.Errorf("lock file = %q, want only our pid %q", got, want)
+	}
+}
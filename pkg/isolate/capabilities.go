@@ -0,0 +1,298 @@
+package isolate
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"syscall"
+
+	"golang.org/x/exp/slog"
+)
+
+// ErrMissingRequirement is returned when the host lacks something isolate
+// needs to run programs.
+var ErrMissingRequirement = errors.New("missing isolate requirement")
+
+// Check is the outcome of a single environment check.
+type Check struct {
+	Name string
+	OK   bool
+	// Required checks must pass for runs to start, the others only warn
+	// about things that make measurements less reliable.
+	Required bool
+	Detail   string
+}
+
+// Capabilities describes what the isolate installation and the host
+// support, along the lines of isolate-check-environment.
+type Capabilities struct {
+	// Version is parsed from `isolate --version`, VersionOutput is the raw
+	// output.
+	Version       string
+	VersionOutput string
+	// CgroupVersion is 1 or 2, or 0 when /sys/fs/cgroup is neither.
+	CgroupVersion int
+	// CgroupsWork is set when a box could be initialized with --cg. It's
+	// only probed when IsolateConfig.UseCgroups is set.
+	CgroupsWork bool
+	BoxRoot     string
+	Checks      []Check
+}
+
+// Missing returns the required checks that failed.
+func (caps *Capabilities) Missing() []Check {
+	var missing []Check
+	for _, check := range caps.Checks {
+		if check.Required && !check.OK {
+			missing = append(missing, check)
+		}
+	}
+	return missing
+}
+
+// Warnings returns the optional checks that failed.
+func (caps *Capabilities) Warnings() []Check {
+	var warnings []Check
+	for _, check := range caps.Checks {
+		if !check.Required && !check.OK {
+			warnings = append(warnings, check)
+		}
+	}
+	return warnings
+}
+
+// Err wraps ErrMissingRequirement if a required check failed.
+func (caps *Capabilities) Err() error {
+	missing := caps.Missing()
+	if len(missing) == 0 {
+		return nil
+	}
+	details := make([]string, len(missing))
+	for i, check := range missing {
+		details[i] = check.Name + ": " + check.Detail
+	}
+	return fmt.Errorf("%w: %s", ErrMissingRequirement, strings.Join(details, "; "))
+}
+
+// ProbeCapabilities inspects the isolate installation described by config
+// without failing on missing requirements, e.g. to report on them.
+func ProbeCapabilities(config IsolateConfig) *Capabilities {
+	isolate := &Isolate{
+		config:   config,
+		idsInUse: make(map[int]*BoxLock),
+	}
+	return isolate.probeCapabilities()
+}
+
+// Capabilities returns the report made when the isolate was created.
+func (isolate *Isolate) Capabilities() *Capabilities {
+	return isolate.capabilities
+}
+
+func (isolate *Isolate) probeCapabilities() *Capabilities {
+	caps := &Capabilities{BoxRoot: isolate.BoxRoot()}
+
+	caps.Checks = append(caps.Checks, isolate.checkVersion(caps))
+	caps.CgroupVersion = cgroupVersion()
+	if caps.Version != "" {
+		caps.Checks = append(caps.Checks, isolate.checkInit(caps))
+	}
+	if !isolate.config.UseCgroups {
+		caps.Checks = append(caps.Checks, Check{
+			Name:   "control groups",
+			Detail: "disabled, memory is limited per process and measured as max-rss",
+		})
+	}
+	caps.Checks = append(caps.Checks,
+		checkBoxRoot(caps.BoxRoot),
+		checkSwap(),
+		checkCpuFrequencyScaling(),
+		checkAddressSpaceRandomization(),
+		checkTransparentHugepages())
+
+	for _, check := range caps.Checks {
+		logger := slog.With(slog.String("check", check.Name), slog.String("detail", check.Detail))
+		switch {
+		case check.OK:
+			logger.Debug("isolate environment check passed")
+		case check.Required:
+			logger.Error("isolate environment check failed")
+		default:
+			logger.Warn("isolate environment check failed")
+		}
+	}
+	return caps
+}
+
+var versionPattern = regexp.MustCompile(`\d+(\.\d+)+`)
+
+func (isolate *Isolate) checkVersion(caps *Capabilities) Check {
+	check := Check{Name: "isolate binary", Required: true}
+
+	versionCmd := isolate.command().Version()
+	out, err := exec.Command(versionCmd[0], versionCmd[1:]...).CombinedOutput()
+	caps.VersionOutput = string(out)
+	if err != nil {
+		check.Detail = fmt.Sprintf("%s: %s", strings.Join(versionCmd, " "), err.Error())
+		return check
+	}
+
+	// "The process isolator 2.0" followed by the copyright notice
+	firstLine, _, _ := strings.Cut(caps.VersionOutput, "\n")
+	caps.Version = versionPattern.FindString(firstLine)
+	if caps.Version == "" {
+		caps.Version = "unknown"
+	}
+	check.OK = true
+	check.Detail = "version " + caps.Version
+	return check
+}
+
+const cgroup2SuperMagic = 0x63677270
+
+func cgroupVersion() int {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs("/sys/fs/cgroup", &stat); err != nil {
+		return 0
+	}
+	if stat.Type == cgroup2SuperMagic {
+		return 2
+	}
+	// v1 mounts a tmpfs with one hierarchy per controller
+	if _, err := os.Stat("/sys/fs/cgroup/memory"); err == nil {
+		return 1
+	}
+	return 0
+}
+
+// checkInit initializes and cleans up a spare box. With --cg that fails
+// unless isolate's cgroup setup matches the host.
+func (isolate *Isolate) checkInit(caps *Capabilities) Check {
+	check := Check{Name: "control groups", Required: true}
+	if !isolate.config.UseCgroups {
+		check.Name = "box init"
+	}
+
+	isolate.mutex.Lock()
+	defer isolate.mutex.Unlock()
+
+	boxId, lock, err := isolate.claimBoxId()
+	if err != nil {
+		check.Detail = "no box to try init in: " + err.Error()
+		return check
+	}
+	defer lock.Release()
+
+	initCmd := isolate.command().BoxId(boxId).Init()
+	out, err := exec.Command(initCmd[0], initCmd[1:]...).CombinedOutput()
+	isolate.cleanupBox(boxId)
+	if err != nil {
+		check.Detail = fmt.Sprintf("cgroup v%d, %s failed: %s", caps.CgroupVersion,
+			strings.Join(initCmd, " "), strings.TrimSpace(string(out)))
+		return check
+	}
+
+	check.OK = true
+	check.Detail = "works without cgroups"
+	if isolate.config.UseCgroups {
+		caps.CgroupsWork = true
+		check.Detail = fmt.Sprintf("cgroup v%d, --cg works", caps.CgroupVersion)
+	}
+	return check
+}
+
+func checkBoxRoot(boxRoot string) Check {
+	check := Check{Name: "box root", Detail: boxRoot}
+	info, err := os.Stat(boxRoot)
+	switch {
+	case err != nil:
+		check.Detail = err.Error()
+	case !info.IsDir():
+		check.Detail = boxRoot + " is not a directory"
+	default:
+		check.OK = true
+	}
+	return check
+}
+
+// readSetting returns the trimmed content of a /proc or /sys file.
+func readSetting(path string) (string, error) {
+	content, err := os.ReadFile(path)
+	return strings.TrimSpace(string(content)), err
+}
+
+func checkSwap() Check {
+	check := Check{Name: "swap"}
+	swaps, err := readSetting("/proc/swaps")
+	if err != nil {
+		check.Detail = err.Error()
+		return check
+	}
+	// the first line is a header
+	if lines := strings.Split(swaps, "\n"); len(lines) > 1 {
+		check.Detail = "swap is enabled, memory limits are less reliable"
+		return check
+	}
+	check.OK = true
+	check.Detail = "disabled"
+	return check
+}
+
+func checkCpuFrequencyScaling() Check {
+	check := Check{Name: "cpu frequency scaling", OK: true, Detail: "no scaling governors"}
+	governors, _ := filepath.Glob("/sys/devices/system/cpu/cpu*/cpufreq/scaling_governor")
+	var slow []string
+	for _, path := range governors {
+		governor, err := readSetting(path)
+		if err == nil && governor != "performance" {
+			cpu := filepath.Base(filepath.Dir(filepath.Dir(path)))
+			slow = append(slow, cpu+"="+governor)
+		}
+	}
+	if len(slow) > 0 {
+		check.OK = false
+		check.Detail = "governor isn't performance, timing varies: " + strings.Join(slow, ", ")
+	} else if len(governors) > 0 {
+		check.Detail = "performance governor"
+	}
+	return check
+}
+
+func checkAddressSpaceRandomization() Check {
+	check := Check{Name: "address space randomization"}
+	value, err := readSetting("/proc/sys/kernel/randomize_va_space")
+	switch {
+	case err != nil:
+		check.Detail = err.Error()
+	case value != "0":
+		check.Detail = "kernel.randomize_va_space is " + value + ", memory use varies between runs"
+	default:
+		check.OK = true
+		check.Detail = "disabled"
+	}
+	return check
+}
+
+func checkTransparentHugepages() Check {
+	check := Check{Name: "transparent hugepages", OK: true, Detail: "not available"}
+	var enabled []string
+	for _, setting := range []string{"enabled", "defrag"} {
+		value, err := readSetting(filepath.Join("/sys/kernel/mm/transparent_hugepage", setting))
+		if err != nil {
+			continue
+		}
+		check.Detail = "not always on"
+		if strings.Contains(value, "[always]") {
+			enabled = append(enabled, setting)
+		}
+	}
+	if len(enabled) > 0 {
+		check.OK = false
+		check.Detail = "always " + strings.Join(enabled, " and ") + ", timing and memory use vary"
+	}
+	return check
+}
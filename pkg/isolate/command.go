@@ -0,0 +1,200 @@
+package isolate
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// envBinary is used as the program isolate starts so that the command
+// is looked up in PATH inside the sandbox.
+const envBinary = "/usr/bin/env"
+
+// tasksetBinary pins isolate, and so the box it starts, to some CPUs.
+const tasksetBinary = "taskset"
+
+// CommandBuilder assembles the argument vector of a single isolate
+// invocation. The result is handed to exec directly, no shell is involved,
+// so none of the values are ever interpreted on the host.
+type CommandBuilder struct {
+	binary      string
+	boxId       int
+	cgroups     bool
+	metaPath    string
+	fullEnv     bool
+	env         []string
+	dirs        []DirRule
+	constraints *RuntimeConstraints
+	cpus        []int
+}
+
+func NewCommandBuilder(binary string) *CommandBuilder {
+	return &CommandBuilder{binary: binary}
+}
+
+func (b *CommandBuilder) BoxId(boxId int) *CommandBuilder {
+	b.boxId = boxId
+	return b
+}
+
+func (b *CommandBuilder) Cgroups(enabled bool) *CommandBuilder {
+	b.cgroups = enabled
+	return b
+}
+
+func (b *CommandBuilder) Meta(path string) *CommandBuilder {
+	b.metaPath = path
+	return b
+}
+
+// FullEnv makes isolate pass its whole environment to the program.
+func (b *CommandBuilder) FullEnv(enabled bool) *CommandBuilder {
+	b.fullEnv = enabled
+	return b
+}
+
+// Env adds an --env rule, either "VAR" or "VAR=value".
+func (b *CommandBuilder) Env(rule string) *CommandBuilder {
+	b.env = append(b.env, rule)
+	return b
+}
+
+func (b *CommandBuilder) Dir(rule DirRule) *CommandBuilder {
+	b.dirs = append(b.dirs, rule)
+	return b
+}
+
+func (b *CommandBuilder) Constraints(constraints RuntimeConstraints) *CommandBuilder {
+	b.constraints = &constraints
+	return b
+}
+
+// Cpus runs isolate through taskset, pinned to cpus.
+func (b *CommandBuilder) Cpus(cpus []int) *CommandBuilder {
+	b.cpus = cpus
+	return b
+}
+
+func (b *CommandBuilder) Version() []string {
+	return []string{b.binary, "--version"}
+}
+
+func (b *CommandBuilder) Init() []string {
+	argv := b.boxArgs()
+	if b.constraints != nil {
+		argv = append(argv, b.constraints.ToInitArgs()...)
+	}
+	return append(argv, "--init")
+}
+
+func (b *CommandBuilder) Cleanup() []string {
+	return append(b.boxArgs(), "--cleanup")
+}
+
+// Run returns the argv that runs program inside the box. Every element
+// of program is passed to the sandboxed process as a separate argument.
+func (b *CommandBuilder) Run(program []string) []string {
+	argv := b.boxArgs()
+	if b.metaPath != "" {
+		argv = append(argv, "--meta="+b.metaPath)
+	}
+	if b.fullEnv {
+		argv = append(argv, "--full-env")
+	}
+	for _, rule := range b.env {
+		argv = append(argv, "--env="+rule)
+	}
+	for _, rule := range b.dirs {
+		argv = append(argv, rule.Arg())
+	}
+	if b.constraints != nil {
+		argv = append(argv, b.constraints.ToArgs(b.cgroups)...)
+	}
+	argv = append(argv, "--run", "--", envBinary)
+	argv = append(argv, program...)
+	if len(b.cpus) > 0 {
+		argv = append([]string{tasksetBinary, "--cpu-list", CpuList(b.cpus)}, argv...)
+	}
+	return argv
+}
+
+// CpuList formats cpus the way taskset and cpusets take them, e.g. "0,2".
+func CpuList(cpus []int) string {
+	list := make([]string, len(cpus))
+	for i, cpu := range cpus {
+		list[i] = strconv.Itoa(cpu)
+	}
+	return strings.Join(list, ",")
+}
+
+func (b *CommandBuilder) boxArgs() []string {
+	argv := []string{b.binary}
+	if b.cgroups {
+		argv = append(argv, "--cg")
+	}
+	return append(argv, fmt.Sprintf("--box-id=%d", b.boxId))
+}
+
+// SplitCommand splits a command line such as a language's execute_cmd
+// into separate arguments. Single and double quotes group words and a
+// backslash escapes the next character; nothing else is special, there
+// is no variable, glob or command substitution.
+func SplitCommand(command string) ([]string, error) {
+	var args []string
+	var current strings.Builder
+	inWord := false
+	var quote rune
+	escaped := false
+
+	for _, c := range command {
+		switch {
+		case escaped:
+			current.WriteRune(c)
+			escaped = false
+		case quote == '\'':
+			if c == '\'' {
+				quote = 0
+			} else {
+				current.WriteRune(c)
+			}
+		case quote == '"':
+			if c == '"' {
+				quote = 0
+			} else if c == '\\' {
+				escaped = true
+			} else {
+				current.WriteRune(c)
+			}
+		case c == '\\':
+			escaped = true
+			inWord = true
+		case c == '\'' || c == '"':
+			quote = c
+			inWord = true
+		case c == ' ' || c == '\t' || c == '\n':
+			if inWord {
+				args = append(args, current.String())
+				current.Reset()
+				inWord = false
+			}
+		default:
+			current.WriteRune(c)
+			inWord = true
+		}
+	}
+
+	if escaped {
+		return nil, errors.New("command ends with a backslash")
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated %c quote in command", quote)
+	}
+	if inWord {
+		args = append(args, current.String())
+	}
+	if len(args) == 0 {
+		return nil, errors.New("empty command")
+	}
+	return args, nil
+}
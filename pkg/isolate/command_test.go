@@ -0,0 +1,229 @@
+package isolate
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCommandBuilderInit(t *testing.T) {
+	quota := RuntimeConstraints{DiskQuotaInKB: 1024, DiskQuotaInodes: 100}
+	noQuota := DefaultRuntimeConstraints()
+
+	tests := []struct {
+		name    string
+		builder *CommandBuilder
+		want    []string
+	}{
+		{
+			name:    "cgroups",
+			builder: NewCommandBuilder("isolate").Cgroups(true).BoxId(3),
+			want:    []string{"isolate", "--cg", "--box-id=3", "--init"},
+		},
+		{
+			name:    "no cgroups",
+			builder: NewCommandBuilder("isolate").BoxId(3),
+			want:    []string{"isolate", "--box-id=3", "--init"},
+		},
+		{
+			name:    "quota",
+			builder: NewCommandBuilder("isolate").Cgroups(true).BoxId(0).Constraints(quota),
+			want:    []string{"isolate", "--cg", "--box-id=0", "--quota=1024,100", "--init"},
+		},
+		{
+			name:    "constraints without quota",
+			builder: NewCommandBuilder("isolate").BoxId(0).Constraints(noQuota),
+			want:    []string{"isolate", "--box-id=0", "--init"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.builder.Init(); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("Init() = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestCommandBuilderCleanup(t *testing.T) {
+	tests := []struct {
+		name    string
+		builder *CommandBuilder
+		want    []string
+	}{
+		{
+			name:    "cgroups",
+			builder: NewCommandBuilder("/usr/local/bin/isolate").Cgroups(true).BoxId(12),
+			want:    []string{"/usr/local/bin/isolate", "--cg", "--box-id=12", "--cleanup"},
+		},
+		{
+			name:    "no cgroups",
+			builder: NewCommandBuilder("isolate").BoxId(12),
+			want:    []string{"isolate", "--box-id=12", "--cleanup"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.builder.Cleanup(); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("Cleanup() = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestCommandBuilderRun(t *testing.T) {
+	limits := RuntimeConstraints{
+		CpuTimeLimInSec:      1.5,
+		ExtraCpuTimeLimInSec: 0.5,
+		WallTimeLimInSec:     3,
+		MemoryLimitInKB:      65536,
+		MaxProcesses:         4,
+		MaxOpenFiles:         32,
+	}
+	limitArgs := func(memArg string) []string {
+		return []string{memArg, "--time=1.500000", "--extra-time=0.500000",
+			"--wall-time=3.000000", "--processes=4", "--open-files=32"}
+	}
+	optional := limits
+	optional.StackLimitInKB = 8192
+	optional.FileSizeLimitInKB = 1024
+	optional.CoreFileSizeInKB = 2048
+	// the quota only applies on --init
+	quota := limits
+	quota.DiskQuotaInKB = 1024
+	quota.DiskQuotaInodes = 100
+
+	concat := func(parts ...[]string) []string {
+		var argv []string
+		for _, part := range parts {
+			argv = append(argv, part...)
+		}
+		return argv
+	}
+	program := []string{"./main", "arg with space"}
+	run := []string{"--run", "--", "/usr/bin/env", "./main", "arg with space"}
+
+	tests := []struct {
+		name    string
+		builder *CommandBuilder
+		want    []string
+	}{
+		{
+			name:    "bare",
+			builder: NewCommandBuilder("isolate").BoxId(1),
+			want:    concat([]string{"isolate", "--box-id=1"}, run),
+		},
+		{
+			name:    "cgroups limit the box memory",
+			builder: NewCommandBuilder("isolate").Cgroups(true).BoxId(1).Constraints(limits),
+			want:    concat([]string{"isolate", "--cg", "--box-id=1"}, limitArgs("--cg-mem=65536"), run),
+		},
+		{
+			name:    "no cgroups limit the address space",
+			builder: NewCommandBuilder("isolate").BoxId(1).Constraints(limits),
+			want:    concat([]string{"isolate", "--box-id=1"}, limitArgs("--mem=65536"), run),
+		},
+		{
+			name:    "optional limits",
+			builder: NewCommandBuilder("isolate").Cgroups(true).BoxId(1).Constraints(optional),
+			want: concat([]string{"isolate", "--cg", "--box-id=1"}, limitArgs("--cg-mem=65536"),
+				[]string{"--stack=8192", "--fsize=1024", "--core=2048"}, run),
+		},
+		{
+			name:    "quota is left out",
+			builder: NewCommandBuilder("isolate").Cgroups(true).BoxId(1).Constraints(quota),
+			want:    concat([]string{"isolate", "--cg", "--box-id=1"}, limitArgs("--cg-mem=65536"), run),
+		},
+		{
+			name:    "meta and env",
+			builder: NewCommandBuilder("isolate").BoxId(2).Meta("/tmp/meta.txt").FullEnv(true).Env("HOME=/box").Env("PATH"),
+			want: concat([]string{"isolate", "--box-id=2", "--meta=/tmp/meta.txt", "--full-env",
+				"--env=HOME=/box", "--env=PATH"}, run),
+		},
+		{
+			name: "dirs",
+			builder: NewCommandBuilder("isolate").BoxId(2).
+				Dir(DirRule{Inside: "/opt/go", Outside: "/usr/local/go", Maybe: true}).
+				Dir(DirRule{Inside: "/work", ReadWrite: true, NoExec: true}).
+				Dir(DirRule{Inside: "/scratch", Tmp: true}).
+				Dir(DirRule{Inside: "/proc", Outside: "proc", Fs: true}),
+			want: concat([]string{"isolate", "--box-id=2", "--dir=/opt/go=/usr/local/go:maybe",
+				"--dir=/work:rw:noexec", "--dir=/scratch:tmp", "--dir=/proc=proc:fs"}, run),
+		},
+		{
+			name:    "cpus",
+			builder: NewCommandBuilder("isolate").Cgroups(true).BoxId(4).Cpus([]int{2, 5}),
+			want:    concat([]string{"taskset", "--cpu-list", "2,5", "isolate", "--cg", "--box-id=4"}, run),
+		},
+		{
+			name:    "no cpus",
+			builder: NewCommandBuilder("isolate").BoxId(4).Cpus(nil),
+			want:    concat([]string{"isolate", "--box-id=4"}, run),
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.builder.Run(program); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("Run() =\n%q\nwant\n%q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestSplitCommand(t *testing.T) {
+	tests := []struct {
+		command string
+		want    []string
+		wantErr bool
+	}{
+		{command: "./main", want: []string{"./main"}},
+		{command: "  g++  -O2\tmain.cpp \n", want: []string{"g++", "-O2", "main.cpp"}},
+		{command: `python3 -c 'print("a b")'`, want: []string{"python3", "-c", `print("a b")`}},
+		{command: `echo "it's \"quoted\""`, want: []string{"echo", `it's "quoted"`}},
+		{command: `echo 'no \escape'`, want: []string{"echo", `no \escape`}},
+		{command: `echo a\ b \$HOME`, want: []string{"echo", "a b", "$HOME"}},
+		{command: `echo ''`, want: []string{"echo", ""}},
+		{command: `echo a"b"'c'`, want: []string{"echo", "abc"}},
+		{command: `echo $(rm -rf /) *`, want: []string{"echo", "$(rm", "-rf", "/)", "*"}},
+		{command: `echo 'unterminated`, wantErr: true},
+		{command: `echo "unterminated`, wantErr: true},
+		{command: `echo trailing\`, wantErr: true},
+		{command: "", wantErr: true},
+		{command: " \t ", wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.command, func(t *testing.T) {
+			got, err := SplitCommand(test.command)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("SplitCommand(%q) = %q, want an error", test.command, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("SplitCommand(%q): %v", test.command, err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("SplitCommand(%q) = %q, want %q", test.command, got, test.want)
+			}
+		})
+	}
+}
+
+func TestRedactEnvArgs(t *testing.T) {
+	argv := NewCommandBuilder("isolate").BoxId(1).
+		Env("LANG").Env("TOKEN=secret").Env("EMPTY=").
+		Run([]string{"./main", "--env=ARG=kept"})
+	want := []string{"isolate", "--box-id=1", "--env=LANG", "--env=TOKEN=***", "--env=EMPTY=***",
+		"--run", "--", "/usr/bin/env", "./main", "--env=ARG=kept"}
+	if got := redactEnvArgs(argv); !reflect.DeepEqual(got, want) {
+		t.Errorf("redactEnvArgs() = %q, want %q", got, want)
+	}
+	if argv[3] != "--env=TOKEN=secret" {
+		t.Errorf("redactEnvArgs modified its argument: %q", argv)
+	}
+
+	names := EnvNames([]string{"HOME=/box", "TOKEN=a=b", "EMPTY="})
+	if want := []string{"HOME", "TOKEN", "EMPTY"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("EnvNames() = %q, want %q", names, want)
+	}
+}
@@ -1,60 +1,163 @@
 package isolate
 
 import (
+	"errors"
 	"fmt"
 )
 
 type RuntimeConstraints struct {
-    CpuTimeLimInSec float64
-    ExtraCpuTimeLimInSec float64
-    WallTimeLimInSec float64
-    MemoryLimitInKB int
-    MaxProcesses int
-    MaxOpenFiles int
+	CpuTimeLimInSec      float64
+	ExtraCpuTimeLimInSec float64
+	WallTimeLimInSec     float64
+	MemoryLimitInKB      int
+	MaxProcesses         int
+	MaxOpenFiles         int
+
+	// The limits below are optional, zero leaves them to isolate.
+
+	// StackLimitInKB caps the stack, by default it may take the whole
+	// memory limit.
+	StackLimitInKB int
+	// FileSizeLimitInKB caps the size of any file the program writes.
+	FileSizeLimitInKB int
+	// CoreFileSizeInKB allows core dumps up to this size.
+	CoreFileSizeInKB int
+	// DiskQuotaInKB and DiskQuotaInodes limit the disk usage of the whole
+	// box. Isolate applies the quota when the box is initialized, so they
+	// only take effect through Isolate.NewBoxWithConstraints, Run rejects
+	// them, and both must be set together. The runner creates its boxes
+	// through sandbox.Sandbox, which has no constraints, so it can't set
+	// a quota.
+	DiskQuotaInKB   int
+	DiskQuotaInodes int
 }
 
 func DefaultRuntimeConstraints() RuntimeConstraints {
-    return RuntimeConstraints{
-        CpuTimeLimInSec: 2.0,
-        ExtraCpuTimeLimInSec: 0.5,
-        WallTimeLimInSec: 10.0,
-        MemoryLimitInKB: 2048000,
-        MaxProcesses: 128,
-        MaxOpenFiles: 128,
-    }
-}
-
-func (constraints *RuntimeConstraints) ToArgs() []string {
-    return []string{
-        constraints.MemLimArg(),
-        constraints.CpuTimeLimArg(),
-        constraints.ExtraCpuTimeLimArg(),
-        constraints.WallTimeLimArg(),
-        constraints.MaxProcessesArg(),
-        constraints.MaxOpenFilesArg(),
-    }
+	return RuntimeConstraints{
+		CpuTimeLimInSec:      2.0,
+		ExtraCpuTimeLimInSec: 0.5,
+		WallTimeLimInSec:     10.0,
+		MemoryLimitInKB:      2048000,
+		MaxProcesses:         128,
+		MaxOpenFiles:         128,
+		FileSizeLimitInKB:    262144,
+	}
+}
+
+func (constraints *RuntimeConstraints) Validate() error {
+	if constraints.CpuTimeLimInSec <= 0 {
+		return errors.New("cpu time limit must be positive")
+	}
+	if constraints.WallTimeLimInSec <= 0 {
+		return errors.New("wall time limit must be positive")
+	}
+	if constraints.MemoryLimitInKB <= 0 {
+		return errors.New("memory limit must be positive")
+	}
+	if constraints.ExtraCpuTimeLimInSec < 0 ||
+		constraints.MaxProcesses < 0 ||
+		constraints.MaxOpenFiles < 0 ||
+		constraints.StackLimitInKB < 0 ||
+		constraints.FileSizeLimitInKB < 0 ||
+		constraints.CoreFileSizeInKB < 0 ||
+		constraints.DiskQuotaInKB < 0 ||
+		constraints.DiskQuotaInodes < 0 {
+		return errors.New("constraints must not be negative")
+	}
+	if (constraints.DiskQuotaInKB == 0) != (constraints.DiskQuotaInodes == 0) {
+		return errors.New("disk quota needs both a block and an inode limit")
+	}
+	return nil
+}
+
+// ValidateRun is Validate for the constraints of a run, which can't carry
+// a disk quota as isolate only applies it when a box is initialized.
+func (constraints *RuntimeConstraints) ValidateRun() error {
+	if err := constraints.Validate(); err != nil {
+		return err
+	}
+	if constraints.DiskQuotaInKB > 0 || constraints.DiskQuotaInodes > 0 {
+		return errors.New("disk quota applies when a box is created, not per run")
+	}
+	return nil
+}
+
+// ToArgs returns the run arguments. With cgroups the memory limit applies
+// to the whole box through --cg-mem, otherwise it's the address space
+// limit of every process.
+func (constraints *RuntimeConstraints) ToArgs(cgroups bool) []string {
+	memLimArg := constraints.MemLimArg()
+	if cgroups {
+		memLimArg = constraints.CgMemLimArg()
+	}
+	args := []string{
+		memLimArg,
+		constraints.CpuTimeLimArg(),
+		constraints.ExtraCpuTimeLimArg(),
+		constraints.WallTimeLimArg(),
+		constraints.MaxProcessesArg(),
+		constraints.MaxOpenFilesArg(),
+	}
+	if constraints.StackLimitInKB > 0 {
+		args = append(args, constraints.StackLimArg())
+	}
+	if constraints.FileSizeLimitInKB > 0 {
+		args = append(args, constraints.FileSizeLimArg())
+	}
+	if constraints.CoreFileSizeInKB > 0 {
+		args = append(args, constraints.CoreFileSizeArg())
+	}
+	return args
+}
+
+// ToInitArgs returns the arguments that apply when the box is initialized.
+func (constraints *RuntimeConstraints) ToInitArgs() []string {
+	if constraints.DiskQuotaInKB > 0 && constraints.DiskQuotaInodes > 0 {
+		return []string{constraints.DiskQuotaArg()}
+	}
+	return nil
 }
 
 func (constraints *RuntimeConstraints) MemLimArg() string {
-    return fmt.Sprintf("--mem=%d", constraints.MemoryLimitInKB)
+	return fmt.Sprintf("--mem=%d", constraints.MemoryLimitInKB)
+}
+
+func (constraints *RuntimeConstraints) CgMemLimArg() string {
+	return fmt.Sprintf("--cg-mem=%d", constraints.MemoryLimitInKB)
 }
 
 func (constraints *RuntimeConstraints) CpuTimeLimArg() string {
-    return fmt.Sprintf("--time=%f", constraints.CpuTimeLimInSec)
+	return fmt.Sprintf("--time=%f", constraints.CpuTimeLimInSec)
 }
 
 func (constraints *RuntimeConstraints) ExtraCpuTimeLimArg() string {
-    return fmt.Sprintf("--extra-time=%f", constraints.ExtraCpuTimeLimInSec)
+	return fmt.Sprintf("--extra-time=%f", constraints.ExtraCpuTimeLimInSec)
 }
 
 func (constraints *RuntimeConstraints) WallTimeLimArg() string {
-    return fmt.Sprintf("--wall-time=%f", constraints.WallTimeLimInSec)
+	return fmt.Sprintf("--wall-time=%f", constraints.WallTimeLimInSec)
 }
 
 func (constraints *RuntimeConstraints) MaxProcessesArg() string {
-    return fmt.Sprintf("--processes=%d", constraints.MaxProcesses)
+	return fmt.Sprintf("--processes=%d", constraints.MaxProcesses)
 }
 
 func (constraints *RuntimeConstraints) MaxOpenFilesArg() string {
-    return fmt.Sprintf("--open-files=%d", constraints.MaxOpenFiles)
+	return fmt.Sprintf("--open-files=%d", constraints.MaxOpenFiles)
+}
+
+func (constraints *RuntimeConstraints) StackLimArg() string {
+	return fmt.Sprintf("--stack=%d", constraints.StackLimitInKB)
+}
+
+func (constraints *RuntimeConstraints) FileSizeLimArg() string {
+	return fmt.Sprintf("--fsize=%d", constraints.FileSizeLimitInKB)
+}
+
+func (constraints *RuntimeConstraints) CoreFileSizeArg() string {
+	return fmt.Sprintf("--core=%d", constraints.CoreFileSizeInKB)
+}
+
+func (constraints *RuntimeConstraints) DiskQuotaArg() string {
+	return fmt.Sprintf("--quota=%d,%d", constraints.DiskQuotaInKB, constraints.DiskQuotaInodes)
 }
@@ -0,0 +1,128 @@
+package isolate
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// DirRule is an isolate --dir rule that makes a host directory (or a
+// temporary or special filesystem) available inside the sandbox.
+type DirRule struct {
+	// Inside is the absolute path the directory appears at in the sandbox.
+	Inside string `json:"inside"`
+	// Outside is the host directory bound to Inside, the same path by
+	// default. With Fs set it names the filesystem type instead.
+	Outside string `json:"outside,omitempty"`
+	// ReadWrite allows writes, bindings are read-only otherwise.
+	ReadWrite bool `json:"rw,omitempty"`
+	// NoExec disallows executing binaries from the directory.
+	NoExec bool `json:"noexec,omitempty"`
+	// Maybe silently skips the rule if Outside doesn't exist.
+	Maybe bool `json:"maybe,omitempty"`
+	// Tmp creates an empty writable temporary directory instead of a binding.
+	Tmp bool `json:"tmp,omitempty"`
+	// Fs mounts a filesystem of type Outside, e.g. "proc".
+	Fs bool `json:"fs,omitempty"`
+	// Dev allows access to device files.
+	Dev bool `json:"dev,omitempty"`
+	// NoRec binds only the directory itself, not the mounts below it.
+	NoRec bool `json:"norec,omitempty"`
+}
+
+// Validate checks the rule without invoking isolate. Paths can't contain
+// the '=' and ':' separators of isolate's syntax, and unless Maybe is set
+// the bound host directory must exist.
+func (rule DirRule) Validate() error {
+	if rule.Inside == "" || !filepath.IsAbs(rule.Inside) {
+		return fmt.Errorf("dir rule %q: inside path must be absolute", rule.Inside)
+	}
+	if filepath.Clean(rule.Inside) != rule.Inside {
+		return fmt.Errorf("dir rule %q: inside path must be clean", rule.Inside)
+	}
+	if rule.Inside == "/" || rule.Inside == "/box" {
+		return fmt.Errorf("dir rule %q: path is reserved by isolate", rule.Inside)
+	}
+	if strings.ContainsAny(rule.Inside, "=:") || strings.ContainsAny(rule.Outside, "=:") {
+		return fmt.Errorf("dir rule %q: paths can't contain '=' or ':'", rule.Inside)
+	}
+	if rule.Tmp && rule.Fs {
+		return fmt.Errorf("dir rule %q: tmp and fs are exclusive", rule.Inside)
+	}
+
+	switch {
+	case rule.Tmp:
+		if rule.Outside != "" {
+			return fmt.Errorf("dir rule %q: tmp directories have no outside path", rule.Inside)
+		}
+	case rule.Fs:
+		if rule.Outside == "" {
+			return fmt.Errorf("dir rule %q: fs needs a filesystem type as outside", rule.Inside)
+		}
+	default:
+		outside := rule.outside()
+		if !filepath.IsAbs(outside) {
+			return fmt.Errorf("dir rule %q: outside path must be absolute", rule.Inside)
+		}
+		if rule.Maybe {
+			return nil
+		}
+		info, err := os.Stat(outside)
+		if err != nil {
+			return fmt.Errorf("dir rule %q: %w", rule.Inside, err)
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("dir rule %q: %s is not a directory", rule.Inside, outside)
+		}
+	}
+	return nil
+}
+
+func (rule DirRule) outside() string {
+	if rule.Outside == "" {
+		return rule.Inside
+	}
+	return rule.Outside
+}
+
+// Arg formats the rule as isolate's --dir=in[=out][:option...] argument.
+func (rule DirRule) Arg() string {
+	arg := "--dir=" + rule.Inside
+	if rule.Outside != "" {
+		arg += "=" + rule.Outside
+	}
+	options := []struct {
+		set  bool
+		name string
+	}{
+		{rule.ReadWrite, "rw"},
+		{rule.NoExec, "noexec"},
+		{rule.Maybe, "maybe"},
+		{rule.Tmp, "tmp"},
+		{rule.Fs, "fs"},
+		{rule.Dev, "dev"},
+		{rule.NoRec, "norec"},
+	}
+	for _, option := range options {
+		if option.set {
+			arg += ":" + option.name
+		}
+	}
+	return arg
+}
+
+// ValidateDirRules validates every rule and rejects duplicate inside paths.
+func ValidateDirRules(rules []DirRule) error {
+	seen := make(map[string]bool)
+	for _, rule := range rules {
+		if err := rule.Validate(); err != nil {
+			return err
+		}
+		if seen[rule.Inside] {
+			return fmt.Errorf("dir rule %q: duplicate inside path", rule.Inside)
+		}
+		seen[rule.Inside] = true
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+package isolate
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Environment controls which environment variables a sandboxed command
+// sees. Isolate starts commands with an empty environment apart from
+// HOME=/box, which Set can override.
+type Environment struct {
+	// FullEnv passes the whole environment of the runner.
+	FullEnv bool `json:"full_env,omitempty"`
+	// Inherit lists host variables passed through when they are set.
+	Inherit []string `json:"inherit,omitempty"`
+	// Set assigns literal values, taking precedence over inherited ones.
+	Set map[string]string `json:"set,omitempty"`
+}
+
+func DefaultEnvironment() Environment {
+	return Environment{
+		Set: map[string]string{"HOME": "/box"},
+	}
+}
+
+// Merge returns env extended by other, whose literal values win.
+func (env Environment) Merge(other Environment) Environment {
+	merged := Environment{
+		FullEnv: env.FullEnv || other.FullEnv,
+		Inherit: append(append([]string(nil), env.Inherit...), other.Inherit...),
+		Set:     make(map[string]string, len(env.Set)+len(other.Set)),
+	}
+	for name, value := range env.Set {
+		merged.Set[name] = value
+	}
+	for name, value := range other.Set {
+		merged.Set[name] = value
+	}
+	return merged
+}
+
+func (env Environment) Validate() error {
+	for _, name := range env.Inherit {
+		if err := validateEnvName(name); err != nil {
+			return err
+		}
+	}
+	for name := range env.Set {
+		if err := validateEnvName(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateEnvName(name string) error {
+	if name == "" || strings.ContainsAny(name, "=\x00") {
+		return fmt.Errorf("invalid environment variable name %q", name)
+	}
+	return nil
+}
+
+// Rules returns the isolate --env rules, inherited variables first so
+// that literal values override them.
+func (env Environment) Rules() []string {
+	rules := append([]string(nil), env.Inherit...)
+	for _, name := range env.setNames() {
+		rules = append(rules, name+"="+env.Set[name])
+	}
+	return rules
+}
+
+// Resolve returns the environment the command will see as sorted
+// NAME=value pairs, looking inherited variables up in the runner's own
+// environment.
+func (env Environment) Resolve() []string {
+	values := make(map[string]string)
+	if env.FullEnv {
+		for _, pair := range os.Environ() {
+			name, value, _ := strings.Cut(pair, "=")
+			values[name] = value
+		}
+	}
+	for _, name := range env.Inherit {
+		if value, ok := os.LookupEnv(name); ok {
+			values[name] = value
+		}
+	}
+	for name, value := range env.Set {
+		values[name] = value
+	}
+
+	resolved := make([]string, 0, len(values))
+	for name, value := range values {
+		resolved = append(resolved, name+"="+value)
+	}
+	sort.Strings(resolved)
+	return resolved
+}
+
+// EnvNames returns the names of NAME=value pairs, for logging an
+// environment without its values.
+func EnvNames(pairs []string) []string {
+	names := make([]string, 0, len(pairs))
+	for _, pair := range pairs {
+		name, _, _ := strings.Cut(pair, "=")
+		names = append(names, name)
+	}
+	return names
+}
+
+// redactEnvArgs returns argv with the values of the --env rules before
+// "--" hidden, for logging an isolate command.
+func redactEnvArgs(argv []string) []string {
+	redacted := append([]string(nil), argv...)
+	for i, arg := range redacted {
+		if arg == "--" {
+			break
+		}
+		if !strings.HasPrefix(arg, "--env=") {
+			continue
+		}
+		if name, _, ok := strings.Cut(strings.TrimPrefix(arg, "--env="), "="); ok {
+			redacted[i] = "--env=" + name + "=***"
+		}
+	}
+	return redacted
+}
+
+func (env Environment) setNames() []string {
+	names := make([]string, 0, len(env.Set))
+	for name := range env.Set {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,257 @@
+package isolate
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"golang.org/x/exp/slog"
+)
+
+// ErrPathOutsideBox is returned for paths that would resolve outside the
+// box directory, be it through ".." or a symlink the program created.
+var ErrPathOutsideBox = errors.New("path leads outside of the box directory")
+
+// BoxFile describes an entry of the box directory.
+type BoxFile struct {
+	// Path is relative to the box directory and uses forward slashes.
+	Path  string
+	Size  int64
+	Mode  fs.FileMode
+	IsDir bool
+}
+
+// boxDir is the directory the sandboxed program sees as /box.
+func (box *IsolateBox) boxDir() string {
+	return filepath.Join(box.path, "box")
+}
+
+// hostPath maps a path relative to the box directory to the host. The
+// box is writable by the sandboxed program, so none of the components
+// may be a symlink: the runner must not follow one out of the box.
+func (box *IsolateBox) hostPath(path string) (string, error) {
+	if path == "" || filepath.IsAbs(path) {
+		return "", fmt.Errorf("%w: %q", ErrPathOutsideBox, path)
+	}
+	clean := filepath.Clean(path)
+	if clean == "." || clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", fmt.Errorf("%w: %q", ErrPathOutsideBox, path)
+	}
+
+	current := box.boxDir()
+	for _, component := range strings.Split(clean, string(filepath.Separator)) {
+		current = filepath.Join(current, component)
+		info, err := os.Lstat(current)
+		if errors.Is(err, fs.ErrNotExist) {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		if info.Mode()&fs.ModeSymlink != 0 {
+			return "", fmt.Errorf("%w: %q is a symlink", ErrPathOutsideBox, path)
+		}
+	}
+	return filepath.Join(box.boxDir(), clean), nil
+}
+
+// chown hands a created entry over to the owner of the box directory so
+// that the sandboxed program can modify it. Only root can do that.
+func (box *IsolateBox) chown(hostPath string) error {
+	if os.Geteuid() != 0 {
+		return nil
+	}
+	info, err := os.Stat(box.boxDir())
+	if err != nil {
+		return err
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+	return os.Lchown(hostPath, int(stat.Uid), int(stat.Gid))
+}
+
+func (box *IsolateBox) AddFile(path string, content []byte) error {
+	return box.AddFileWithMode(path, content, 0644)
+}
+
+// AddFileWithMode writes a file with the given permissions, e.g. 0755
+// for executables and scripts. Missing parent directories are created.
+func (box *IsolateBox) AddFileWithMode(path string, content []byte, mode fs.FileMode) error {
+	box.logger.Info("adding file to box", slog.String("file-path", path),
+		slog.String("mode", mode.String()))
+	return box.writeFile(path, bytes.NewReader(content), mode)
+}
+
+func (box *IsolateBox) writeFile(path string, content io.Reader, mode fs.FileMode) error {
+	if dir := filepath.Dir(path); dir != "." {
+		if err := box.AddDir(dir, 0755); err != nil {
+			return err
+		}
+	}
+	hostPath, err := box.hostPath(path)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(hostPath,
+		os.O_WRONLY|os.O_CREATE|os.O_TRUNC|syscall.O_NOFOLLOW, mode)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(file, content)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	// the mode passed to open is subject to umask and ignored for
+	// existing files
+	if err = os.Chmod(hostPath, mode); err != nil {
+		return err
+	}
+	return box.chown(hostPath)
+}
+
+// AddDir creates a directory along with any missing parents.
+func (box *IsolateBox) AddDir(path string, mode fs.FileMode) error {
+	hostPath, err := box.hostPath(path)
+	if err != nil {
+		return err
+	}
+
+	// create the components one by one so that each one gets chowned
+	current := box.boxDir()
+	for _, component := range strings.Split(filepath.Clean(path), string(filepath.Separator)) {
+		current = filepath.Join(current, component)
+		err = os.Mkdir(current, mode)
+		if errors.Is(err, fs.ErrExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err = os.Chmod(current, mode); err != nil {
+			return err
+		}
+		if err = box.chown(current); err != nil {
+			return err
+		}
+	}
+
+	info, err := os.Lstat(hostPath)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%q exists and is not a directory", path)
+	}
+	return nil
+}
+
+// ReadFile reads a file the program produced.
+func (box *IsolateBox) ReadFile(path string) ([]byte, error) {
+	hostPath, err := box.hostPath(path)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(hostPath, os.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return io.ReadAll(file)
+}
+
+// ListFiles lists the whole box directory recursively. Symlinks are
+// listed but not followed.
+func (box *IsolateBox) ListFiles() ([]BoxFile, error) {
+	root := box.boxDir()
+	var files []BoxFile
+	err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == root {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		relative, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		files = append(files, BoxFile{
+			Path:  filepath.ToSlash(relative),
+			Size:  info.Size(),
+			Mode:  info.Mode(),
+			IsDir: entry.IsDir(),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// RemoveFile removes a file, or a directory with everything in it.
+func (box *IsolateBox) RemoveFile(path string) error {
+	hostPath, err := box.hostPath(path)
+	if err != nil {
+		return err
+	}
+	box.logger.Info("removing file from box", slog.String("file-path", path))
+	return os.RemoveAll(hostPath)
+}
+
+func (box *IsolateBox) Chmod(path string, mode fs.FileMode) error {
+	hostPath, err := box.hostPath(path)
+	if err != nil {
+		return err
+	}
+	return os.Chmod(hostPath, mode)
+}
+
+// AddTar extracts a tar stream into the box. Only regular files and
+// directories are accepted, entries keep their permission bits.
+func (box *IsolateBox) AddTar(archive io.Reader) error {
+	reader := tar.NewReader(archive)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		name := strings.TrimPrefix(header.Name, "./")
+		if name == "" || name == "." {
+			continue
+		}
+		mode := fs.FileMode(header.Mode).Perm()
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = box.AddDir(name, mode)
+		case tar.TypeReg:
+			err = box.writeFile(name, reader, mode)
+		default:
+			err = fmt.Errorf("tar entry %q: unsupported type %c", header.Name, header.Typeflag)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
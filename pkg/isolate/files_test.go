@@ -0,0 +1,226 @@
+package isolate
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newTestBox returns a box backed by a temporary directory along with a
+// directory outside of it that must stay untouched.
+func newTestBox(t *testing.T) (box *IsolateBox, outside string) {
+	t.Helper()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "0")
+	if err := os.MkdirAll(filepath.Join(path, "box"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	outside = filepath.Join(dir, "outside")
+	if err := os.Mkdir(outside, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(outside, "secret"), []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return NewIsolateBox(nil, 0, path), outside
+}
+
+// symlinkInBox creates a symlink the way a sandboxed program could.
+func symlinkInBox(t *testing.T, box *IsolateBox, name string, target string) {
+	t.Helper()
+	if err := os.Symlink(target, filepath.Join(box.boxDir(), name)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// checkOutside fails the test if anything outside the box was changed.
+func checkOutside(t *testing.T, outside string) {
+	t.Helper()
+	entries, err := os.ReadDir(outside)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "secret" {
+		t.Errorf("outside directory holds %v, want only secret", entries)
+	}
+	content, err := os.ReadFile(filepath.Join(outside, "secret"))
+	if err != nil || string(content) != "secret" {
+		t.Errorf("outside file = %q, %v, want it unchanged", content, err)
+	}
+	if _, err = os.Stat(filepath.Join(filepath.Dir(outside), "evil")); err == nil {
+		t.Errorf("a file was written next to the box")
+	}
+}
+
+func TestHostPath(t *testing.T) {
+	box, _ := newTestBox(t)
+	for _, path := range []string{"", ".", "..", "../evil", "a/../../evil", "/etc/passwd"} {
+		if _, err := box.hostPath(path); !errors.Is(err, ErrPathOutsideBox) {
+			t.Errorf("hostPath(%q) error = %v, want ErrPathOutsideBox", path, err)
+		}
+	}
+
+	got, err := box.hostPath("a/./b/../c")
+	if err != nil {
+		t.Fatalf("hostPath() error = %v", err)
+	}
+	if want := filepath.Join(box.boxDir(), "a", "c"); got != want {
+		t.Errorf("hostPath() = %q, want %q", got, want)
+	}
+}
+
+func TestFilesRejectSymlinks(t *testing.T) {
+	tests := []struct {
+		name string
+		// link is created in the box and points to target, a path in
+		// the directory outside the box, or its relative form from
+		// the box directory
+		link     string
+		target   string
+		relative bool
+		// path is passed to the file operations
+		path string
+	}{
+		{name: "final component", link: "main.out", target: "secret", path: "main.out"},
+		{name: "directory component", link: "dir", target: ".", path: "dir/secret"},
+		{name: "relative directory component", link: "dir", target: ".", relative: true, path: "dir/secret"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			box, outside := newTestBox(t)
+			target := filepath.Join(outside, test.target)
+			if test.relative {
+				target = filepath.Join("..", "..", "outside", test.target)
+			}
+			symlinkInBox(t, box, test.link, target)
+
+			if content, err := box.ReadFile(test.path); !errors.Is(err, ErrPathOutsideBox) {
+				t.Errorf("ReadFile() = %q, %v, want ErrPathOutsideBox", content, err)
+			}
+			if err := box.AddFile(test.path, []byte("evil")); !errors.Is(err, ErrPathOutsideBox) {
+				t.Errorf("AddFile() error = %v, want ErrPathOutsideBox", err)
+			}
+			if err := box.AddFile(filepath.Join(test.link, "new"), []byte("evil")); !errors.Is(err, ErrPathOutsideBox) {
+				t.Errorf("AddFile() below the link error = %v, want ErrPathOutsideBox", err)
+			}
+			if err := box.RemoveFile(test.path); !errors.Is(err, ErrPathOutsideBox) {
+				t.Errorf("RemoveFile() error = %v, want ErrPathOutsideBox", err)
+			}
+			checkOutside(t, outside)
+		})
+	}
+}
+
+func TestFilesRejectTraversal(t *testing.T) {
+	box, outside := newTestBox(t)
+	for _, path := range []string{"../evil", "../outside/secret", "/etc/passwd"} {
+		if content, err := box.ReadFile(path); !errors.Is(err, ErrPathOutsideBox) {
+			t.Errorf("ReadFile(%q) = %q, %v, want ErrPathOutsideBox", path, content, err)
+		}
+		if err := box.AddFile(path, []byte("evil")); !errors.Is(err, ErrPathOutsideBox) {
+			t.Errorf("AddFile(%q) error = %v, want ErrPathOutsideBox", path, err)
+		}
+		if err := box.RemoveFile(path); !errors.Is(err, ErrPathOutsideBox) {
+			t.Errorf("RemoveFile(%q) error = %v, want ErrPathOutsideBox", path, err)
+		}
+	}
+	checkOutside(t, outside)
+}
+
+// tarEntry is a single entry of an archive built by buildTar.
+type tarEntry struct {
+	header  tar.Header
+	content string
+}
+
+func buildTar(t *testing.T, entries ...tarEntry) *bytes.Buffer {
+	t.Helper()
+	var archive bytes.Buffer
+	writer := tar.NewWriter(&archive)
+	for _, entry := range entries {
+		header := entry.header
+		header.Size = int64(len(entry.content))
+		if err := writer.WriteHeader(&header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := writer.Write([]byte(entry.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &archive
+}
+
+func TestAddTar(t *testing.T) {
+	box, _ := newTestBox(t)
+	archive := buildTar(t,
+		tarEntry{header: tar.Header{Name: "./", Typeflag: tar.TypeDir, Mode: 0755}},
+		tarEntry{header: tar.Header{Name: "./lib/", Typeflag: tar.TypeDir, Mode: 0700}},
+		tarEntry{header: tar.Header{Name: "./lib/data.txt", Typeflag: tar.TypeReg, Mode: 0600}, content: "data"},
+		tarEntry{header: tar.Header{Name: "run.sh", Typeflag: tar.TypeReg, Mode: 0755}, content: "#!/bin/sh\n"},
+	)
+	if err := box.AddTar(archive); err != nil {
+		t.Fatalf("AddTar() error = %v", err)
+	}
+
+	content, err := box.ReadFile("lib/data.txt")
+	if err != nil || string(content) != "data" {
+		t.Errorf("ReadFile() = %q, %v, want data", content, err)
+	}
+	for path, want := range map[string]os.FileMode{"lib": 0700, "lib/data.txt": 0600, "run.sh": 0755} {
+		info, err := os.Stat(filepath.Join(box.boxDir(), path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := info.Mode().Perm(); got != want {
+			t.Errorf("mode of %s = %v, want %v", path, got, want)
+		}
+	}
+}
+
+func TestAddTarRejectsEscapes(t *testing.T) {
+	tests := []struct {
+		name    string
+		entry   tarEntry
+		outside bool
+	}{
+		{name: "parent", entry: tarEntry{header: tar.Header{Name: "../evil", Typeflag: tar.TypeReg, Mode: 0644}, content: "evil"}, outside: true},
+		{name: "nested parent", entry: tarEntry{header: tar.Header{Name: "a/../../evil", Typeflag: tar.TypeReg, Mode: 0644}, content: "evil"}, outside: true},
+		{name: "parent directory", entry: tarEntry{header: tar.Header{Name: "../evil/", Typeflag: tar.TypeDir, Mode: 0755}}, outside: true},
+		{name: "absolute", entry: tarEntry{header: tar.Header{Name: "/tmp/evil", Typeflag: tar.TypeReg, Mode: 0644}, content: "evil"}, outside: true},
+		{name: "symlink", entry: tarEntry{header: tar.Header{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "../outside"}}},
+		{name: "hardlink", entry: tarEntry{header: tar.Header{Name: "link", Typeflag: tar.TypeLink, Linkname: "../outside/secret"}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			box, outside := newTestBox(t)
+			err := box.AddTar(buildTar(t, test.entry))
+			if err == nil {
+				t.Fatalf("AddTar() succeeded, want an error")
+			}
+			if test.outside && !errors.Is(err, ErrPathOutsideBox) {
+				t.Errorf("AddTar() error = %v, want ErrPathOutsideBox", err)
+			}
+			if _, err = os.Lstat(filepath.Join(box.boxDir(), "link")); err == nil {
+				t.Errorf("AddTar() created a link")
+			}
+			checkOutside(t, outside)
+		})
+	}
+}
+
+func TestAddTarRejectsSymlinkInBox(t *testing.T) {
+	box, outside := newTestBox(t)
+	symlinkInBox(t, box, "dir", outside)
+	archive := buildTar(t,
+		tarEntry{header: tar.Header{Name: "dir/evil", Typeflag: tar.TypeReg, Mode: 0644}, content: "evil"})
+	if err := box.AddTar(archive); !errors.Is(err, ErrPathOutsideBox) {
+		t.Errorf("AddTar() error = %v, want ErrPathOutsideBox", err)
+	}
+	checkOutside(t, outside)
+}
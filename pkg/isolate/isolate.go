@@ -1,6 +1,7 @@
 package isolate
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -9,67 +10,135 @@ import (
 	"path/filepath"
 	"strings"
 	"sync"
+	"time"
 
 	"golang.org/x/exp/slog"
 )
 
+type IsolateConfig struct {
+	// BinaryPath is the isolate executable. A bare name is looked up in PATH.
+	BinaryPath string
+	// MinBoxId and MaxBoxId bound (inclusively) the box ids this runner
+	// may claim. Give runners on one host disjoint or shared ranges.
+	MinBoxId int
+	MaxBoxId int
+	// LockDir holds the per box id lock files. Every runner on the host
+	// must use the same directory for ids to be allocated safely.
+	LockDir string
+	// BoxRoot overrides the box root read from isolate's config file.
+	BoxRoot string
+	// MetaFileMaxAge is how old a meta file must be for Reconcile to
+	// consider it left behind.
+	MetaFileMaxAge time.Duration
+	// ReconcileOnStartup makes NewIsolateWithConfig run Reconcile. It's
+	// off by default: Reconcile cleans up every unlocked box in the id
+	// range, so the range must not overlap boxes of other isolate users.
+	ReconcileOnStartup bool
+	// UseCgroups runs every box with --cg. Without control groups the
+	// memory limit only caps the address space of each process and memory
+	// use is measured as the peak resident set size, see
+	// IsolateMetrics.WeakAccounting.
+	UseCgroups bool
+}
+
+func DefaultIsolateConfig() IsolateConfig {
+	return IsolateConfig{
+		BinaryPath:         "isolate",
+		MinBoxId:           0,
+		MaxBoxId:           999,
+		LockDir:            filepath.Join(os.TempDir(), "isolate", "locks"),
+		MetaFileMaxAge:     time.Hour,
+		ReconcileOnStartup: false,
+		UseCgroups:         true,
+	}
+}
+
 type Isolate struct {
-	idsInUse []int
-	mutex    sync.Mutex
+	config       IsolateConfig
+	idsInUse     map[int]*BoxLock
+	mutex        sync.Mutex
+	capabilities *Capabilities
 }
 
 func NewIsolate() (*Isolate, error) {
-	versionCmdStr := fmt.Sprintf("isolate --version")
-	logger := slog.With(slog.String("cmd", versionCmdStr))
+	return NewIsolateWithConfig(DefaultIsolateConfig())
+}
 
-	versionCmd := exec.Command("/usr/bin/bash", "-c", versionCmdStr)
-	out, err := versionCmd.CombinedOutput()
-	if err != nil {
+func NewIsolateWithConfig(config IsolateConfig) (*Isolate, error) {
+	if config.MinBoxId < 0 || config.MaxBoxId < config.MinBoxId {
+		return nil, fmt.Errorf("invalid box id range %d-%d",
+			config.MinBoxId, config.MaxBoxId)
+	}
+
+	isolate := &Isolate{
+		config:   config,
+		idsInUse: make(map[int]*BoxLock),
+	}
+
+	// runs don't start on a host that lacks a requirement
+	isolate.capabilities = isolate.probeCapabilities()
+	if err := isolate.capabilities.Err(); err != nil {
 		return nil, err
 	}
 
-	logger.Info("ran isolate version command", slog.String("output", string(out)))
+	slog.Info("probed isolate capabilities",
+		slog.String("version", isolate.capabilities.Version),
+		slog.Int("cgroup-version", isolate.capabilities.CgroupVersion),
+		slog.Int("warnings", len(isolate.capabilities.Warnings())))
 
-	return &Isolate{}, nil
+	if config.ReconcileOnStartup {
+		isolate.Reconcile()
+	}
+
+	return isolate, nil
 }
 
-func (isolate *Isolate) isBoxIdInUse(boxId int) bool {
-	for _, idInUse := range isolate.idsInUse {
-		if idInUse == boxId {
-			return true
-		}
-	}
-	return false
+const metaFilePattern = "runner.*.txt"
+
+// metaDir is where the --meta files of running commands are created.
+func (isolate *Isolate) metaDir() string {
+	return filepath.Join(os.TempDir(), "isolate")
+}
+
+func (isolate *Isolate) command() *CommandBuilder {
+	return NewCommandBuilder(isolate.config.BinaryPath).Cgroups(isolate.config.UseCgroups)
 }
 
 func (isolate *Isolate) NewBox() (*IsolateBox, error) {
+	return isolate.NewBoxWithConstraints(DefaultRuntimeConstraints())
+}
+
+// NewBoxWithConstraints initializes a box with the init time constraints,
+// currently the disk quota, taken from constraints.
+func (isolate *Isolate) NewBoxWithConstraints(constraints RuntimeConstraints) (*IsolateBox, error) {
+	if err := constraints.Validate(); err != nil {
+		return nil, err
+	}
+
 	isolate.mutex.Lock()
 	defer isolate.mutex.Unlock()
 
-	boxId := 0
-	for isolate.isBoxIdInUse(boxId) {
-		boxId++
+	boxId, lock, err := isolate.claimBoxId()
+	if err != nil {
+		return nil, err
 	}
 
 	logger := slog.With(slog.Int("box-id", boxId))
 
-	cleanCmdStr := fmt.Sprintf("isolate --cg --cleanup --box-id %d", boxId)
-	logger = logger.With(slog.String("cmd", cleanCmdStr))
-
-	cleanCmd := exec.Command("/usr/bin/bash", "-c", cleanCmdStr)
-	cleanOut, err := cleanCmd.CombinedOutput()
+	cleanOut, err := isolate.cleanupBox(boxId)
 	if err != nil {
+		lock.Release()
 		return nil, err
 	}
 
 	logger.Info("ran isolate cleanup command", slog.String("output", string(cleanOut)))
 
-	initCmdStr := fmt.Sprintf("isolate --cg --init --box-id %d", boxId)
-	logger = logger.With(slog.String("cmd", initCmdStr))
+	initCmd := isolate.command().BoxId(boxId).Constraints(constraints).Init()
+	logger = logger.With(slog.String("cmd", strings.Join(initCmd, " ")))
 
-	initCmd := exec.Command("/usr/bin/bash", "-c", initCmdStr)
-	initOut, err := initCmd.CombinedOutput()
+	initOut, err := exec.Command(initCmd[0], initCmd[1:]...).CombinedOutput()
 	if err != nil {
+		lock.Release()
 		return nil, err
 	}
 
@@ -77,81 +146,168 @@ func (isolate *Isolate) NewBox() (*IsolateBox, error) {
 	logger.Info("ran isolate init command", slog.String("output", initOutStr))
 
 	boxPath := initOutStr
-    boxPath = strings.TrimSuffix(boxPath, "\n")
+	boxPath = strings.TrimSuffix(boxPath, "\n")
 
-	isolate.idsInUse = append(isolate.idsInUse, boxId)
+	isolate.idsInUse[boxId] = lock
 	return NewIsolateBox(isolate, boxId, boxPath), nil
 }
 
+// claimBoxId finds a box id in the configured range that neither this
+// nor any other runner process holds and locks it. Must be called with
+// the mutex held.
+func (isolate *Isolate) claimBoxId() (int, *BoxLock, error) {
+	for boxId := isolate.config.MinBoxId; boxId <= isolate.config.MaxBoxId; boxId++ {
+		if isolate.idsInUse[boxId] != nil {
+			continue
+		}
+		lock, stalePid, err := TryLockBoxId(isolate.config.LockDir, boxId)
+		if err != nil {
+			return 0, nil, err
+		}
+		if lock == nil {
+			continue
+		}
+		if stalePid != 0 {
+			// the box gets cleaned up before init like any other
+			slog.Warn("recovering box id abandoned by a crashed process",
+				slog.Int("box-id", boxId), slog.Int("pid", stalePid))
+		}
+		return boxId, lock, nil
+	}
+	return 0, nil, fmt.Errorf("no free box id in range %d-%d",
+		isolate.config.MinBoxId, isolate.config.MaxBoxId)
+}
+
 func (isolate *Isolate) EraseBox(boxId int) error {
 	isolate.mutex.Lock()
 	defer isolate.mutex.Unlock()
-    logger := slog.With(slog.Int("box-id", boxId))
-
-	cleanCmdStr := fmt.Sprintf("isolate --cg --cleanup --box-id %d", boxId)
-	logger = logger.With(slog.String("cmd", cleanCmdStr))
-	
-    cleanCmd := exec.Command("/usr/bin/bash", "-c", cleanCmdStr)
-	cleanOut, err := cleanCmd.CombinedOutput()
-    
-    logger = logger.With(slog.String("output", string(cleanOut)))
-    logger.Info("erased isolate box")
+	logger := slog.With(slog.Int("box-id", boxId))
+
+	cleanOut, err := isolate.cleanupBox(boxId)
+
+	logger = logger.With(slog.String("output", string(cleanOut)))
+	logger.Info("erased isolate box")
 	if err != nil {
 		return err
 	}
+	if lock := isolate.idsInUse[boxId]; lock != nil {
+		delete(isolate.idsInUse, boxId)
+		return lock.Release()
+	}
 	return nil
 }
 
-func (isolate *Isolate) StartCommand(
+// cleanupBox runs `isolate --cleanup`, which kills whatever still runs in
+// the box and removes its directory. The box id stays claimed.
+func (isolate *Isolate) cleanupBox(boxId int) ([]byte, error) {
+	cleanCmd := isolate.command().BoxId(boxId).Cleanup()
+	return exec.Command(cleanCmd[0], cleanCmd[1:]...).CombinedOutput()
+}
+
+// StartCommand starts command in the box. Cancelling ctx kills it, see
+// IsolateProcess.Wait. Input is forwarded from stdin as it arrives, so it
+// may stay open while the command runs; it's closed once the command
+// exits.
+func (isolate *Isolate) StartCommand(ctx context.Context,
 	boxId int, command string, stdin io.ReadCloser,
-	constraints RuntimeConstraints) (*IsolateProcess,error) {
-
-    var process *IsolateProcess = &IsolateProcess{}
-    var err error
-
-    tempDir := filepath.Join(os.TempDir(), "isolate")
-    err = os.MkdirAll(tempDir, 0755)
-    if err != nil {
-        slog.Error("error creating temp dir", slog.String("error", err.Error()))
-        os.Exit(1)
-    }
-
-    file, err := ioutil.TempFile(tempDir, "runner.*.txt")
-    if err != nil {
-        slog.Error("error creating temp file", slog.String("error", err.Error()))
-        os.Exit(1)
-    }
-    file.Close()
-
-    tempFilePath := file.Name()
-    process.metaFilePath = tempFilePath
-
-    runCmdArgs := []string{"--env=HOME=/box", "--meta="+tempFilePath}
-    runCmdArgs = append(runCmdArgs, constraints.ToArgs()...)
-
-	runCmdStr := fmt.Sprintf("isolate --cg --box-id %d %s --run /usr/bin/env %s",
-		boxId, strings.Join(runCmdArgs, " "), command)
-
-    logger := slog.With(slog.Int("box-id", boxId),
-                        slog.String("cmd", runCmdStr))
-
-    cmd := exec.Command("/usr/bin/bash", "-c", runCmdStr)
-    cmd.Stdin = stdin
-    process.stdout, err = cmd.StdoutPipe()
-    if err != nil {
-        return process, err
-    }
-    process.stderr, err = cmd.StderrPipe()
-    if err != nil {
-        return process, err
-    }
-    process.cmd = cmd
-
-	if err = cmd.Start(); err != nil {
+	options RunOptions) (*IsolateProcess, error) {
+
+	var process *IsolateProcess = &IsolateProcess{
+		isolate: isolate,
+		boxId:   boxId,
+		exited:  make(chan struct{}),
+	}
+	var err error
+
+	program, err := SplitCommand(command)
+	if err != nil {
+		return process, err
+	}
+
+	tempDir := isolate.metaDir()
+	err = os.MkdirAll(tempDir, 0755)
+	if err != nil {
+		return process, err
+	}
+
+	file, err := ioutil.TempFile(tempDir, metaFilePattern)
+	if err != nil {
+		return process, err
+	}
+	file.Close()
+
+	tempFilePath := file.Name()
+	process.metaFilePath = tempFilePath
+
+	env := DefaultEnvironment().Merge(options.Env)
+	process.env = env.Resolve()
+
+	builder := isolate.command().
+		BoxId(boxId).
+		Meta(tempFilePath).
+		FullEnv(env.FullEnv)
+	for _, rule := range env.Rules() {
+		builder.Env(rule)
+	}
+	if options.Constraints != nil {
+		builder.Constraints(*options.Constraints)
+	}
+	for _, rule := range options.Dirs {
+		builder.Dir(rule)
+	}
+	builder.Cpus(options.Cpus)
+	runCmd := builder.Run(program)
+
+	logger := slog.With(slog.Int("box-id", boxId),
+		slog.String("cmd", strings.Join(redactEnvArgs(runCmd), " ")))
+
+	cmd := exec.Command(runCmd[0], runCmd[1:]...)
+	var stdinPipe io.WriteCloser
+	if stdin != nil {
+		stdinPipe, err = cmd.StdinPipe()
+		if err != nil {
+			return process, err
+		}
+		process.stdin = stdin
+	}
+	// plain pipes rather than cmd.StdoutPipe, whose read ends cmd.Wait
+	// closes, so that the exit can be waited for while output is read
+	stdoutRead, stdoutWrite, err := os.Pipe()
+	if err != nil {
+		return process, err
+	}
+	stderrRead, stderrWrite, err := os.Pipe()
+	if err != nil {
+		stdoutRead.Close()
+		stdoutWrite.Close()
 		return process, err
 	}
+	cmd.Stdout, cmd.Stderr = stdoutWrite, stderrWrite
+	process.stdout, process.stderr = stdoutRead, stderrRead
+	process.cmd = cmd
+
+	err = cmd.Start()
+	stdoutWrite.Close()
+	stderrWrite.Close()
+	if err != nil {
+		stdoutRead.Close()
+		stderrRead.Close()
+		os.Remove(tempFilePath)
+		return process, err
+	}
+
+	go func() {
+		process.waitErr = cmd.Wait()
+		close(process.exited)
+	}()
+
+	if stdin != nil {
+		go CopyStdin(stdinPipe, stdin)
+	}
+	ctx, process.cancel = context.WithCancel(ctx)
+	go process.watch(ctx)
 
-    logger.Info("started isolate command")
+	logger.Info("started isolate command")
 
 	return process, err
 }
@@ -0,0 +1,66 @@
+package isolate
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ParseMetaFile parses the key:value lines isolate writes to its --meta
+// file. Only the first colon separates the key from the value, so
+// messages containing colons are kept intact. Keys the parser doesn't
+// know about are preserved in IsolateMetrics.Extra.
+func ParseMetaFile(content []byte) (*IsolateMetrics, error) {
+	metrics := &IsolateMetrics{}
+
+	for _, line := range strings.Split(string(content), "\n") {
+		if line == "" {
+			continue
+		}
+
+		key, value, found := strings.Cut(line, ":")
+		if !found {
+			return nil, fmt.Errorf("invalid meta file line: %q", line)
+		}
+
+		var err error
+		switch key {
+		case "time":
+			metrics.TimeSec, err = strconv.ParseFloat(value, 64)
+		case "time-wall":
+			metrics.TimeWallSec, err = strconv.ParseFloat(value, 64)
+		case "max-rss":
+			metrics.MaxRssKb, err = strconv.ParseInt(value, 10, 64)
+		case "csw-voluntary":
+			metrics.CswVoluntary, err = strconv.ParseInt(value, 10, 64)
+		case "csw-forced":
+			metrics.CswForced, err = strconv.ParseInt(value, 10, 64)
+		case "cg-mem":
+			metrics.CgMemKb, err = strconv.ParseInt(value, 10, 64)
+		case "cg-enabled":
+			metrics.CgEnabled, err = strconv.ParseBool(value)
+		case "cg-oom-killed":
+			metrics.CgOomKilled, err = strconv.ParseBool(value)
+		case "killed":
+			metrics.Killed, err = strconv.ParseBool(value)
+		case "exitcode":
+			metrics.ExitCode, err = strconv.ParseInt(value, 10, 64)
+		case "exitsig":
+			metrics.ExitSig, err = strconv.ParseInt(value, 10, 64)
+		case "status":
+			metrics.Status = value
+		case "message":
+			metrics.Message = value
+		default:
+			if metrics.Extra == nil {
+				metrics.Extra = make(map[string]string)
+			}
+			metrics.Extra[key] = value
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid value of meta key %q: %w", key, err)
+		}
+	}
+
+	return metrics, nil
+}
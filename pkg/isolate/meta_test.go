@@ -0,0 +1,89 @@
+package isolate
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseMetaFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    IsolateMetrics
+		wantErr bool
+	}{
+		{
+			name: "full",
+			content: "time:0.112\ntime-wall:0.103\nmax-rss:18984\ncsw-voluntary:1513\n" +
+				"csw-forced:23\ncg-mem:38248\ncg-enabled:1\ncg-oom-killed:1\nkilled:1\n" +
+				"exitcode:3\nexitsig:9\nstatus:SG\nmessage:Caught fatal signal 9\n",
+			want: IsolateMetrics{TimeSec: 0.112, TimeWallSec: 0.103, MaxRssKb: 18984,
+				CswVoluntary: 1513, CswForced: 23, CgMemKb: 38248, CgEnabled: true,
+				CgOomKilled: true, Killed: true, ExitCode: 3, ExitSig: 9,
+				Status: "SG", Message: "Caught fatal signal 9"},
+		},
+		{
+			name:    "message with colons",
+			content: "status:XX\nmessage:execve(\"./main\"): No such file or directory: 2\n",
+			want:    IsolateMetrics{Status: "XX", Message: `execve("./main"): No such file or directory: 2`},
+		},
+		{
+			name:    "unknown keys",
+			content: "time:1\nnew-key:a:b\nempty:\n",
+			want:    IsolateMetrics{TimeSec: 1, Extra: map[string]string{"new-key": "a:b", "empty": ""}},
+		},
+		{
+			name:    "empty",
+			content: "",
+			want:    IsolateMetrics{},
+		},
+		{name: "line without colon", content: "time:1\ngarbage\n", wantErr: true},
+		{name: "malformed float", content: "time:fast\n", wantErr: true},
+		{name: "malformed int", content: "exitcode:1.5\n", wantErr: true},
+		{name: "malformed bool", content: "killed:maybe\n", wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := ParseMetaFile([]byte(test.content))
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("ParseMetaFile() = %+v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseMetaFile() error = %v", err)
+			}
+			if !reflect.DeepEqual(*got, test.want) {
+				t.Errorf("ParseMetaFile() = %+v, want %+v", *got, test.want)
+			}
+		})
+	}
+}
+
+func TestVerdict(t *testing.T) {
+	tests := []struct {
+		name    string
+		metrics IsolateMetrics
+		want    Verdict
+	}{
+		{name: "ok", metrics: IsolateMetrics{}, want: VerdictOK},
+		{name: "exit code without status", metrics: IsolateMetrics{ExitCode: 1}, want: VerdictRE},
+		{name: "runtime error", metrics: IsolateMetrics{Status: "RE", ExitCode: 1}, want: VerdictRE},
+		{name: "signal", metrics: IsolateMetrics{Status: "SG", ExitSig: 11}, want: VerdictSG},
+		{name: "timed out", metrics: IsolateMetrics{Status: "TO"}, want: VerdictTO},
+		{name: "internal error", metrics: IsolateMetrics{Status: "XX"}, want: VerdictXX},
+		{name: "unknown status", metrics: IsolateMetrics{Status: "ZZ"}, want: VerdictXX},
+		{name: "oom kill beats signal", metrics: IsolateMetrics{Status: "SG", ExitSig: 9, CgOomKilled: true}, want: VerdictML},
+		{name: "oom kill beats timeout", metrics: IsolateMetrics{Status: "TO", CgOomKilled: true}, want: VerdictML},
+		{name: "cancelled beats status", metrics: IsolateMetrics{Status: "SG", CgOomKilled: true, Cancelled: true}, want: VerdictCancelled},
+		{name: "output limit beats cancelled", metrics: IsolateMetrics{Cancelled: true, OutputLimitExceeded: true}, want: VerdictOLE},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.metrics.Verdict(); got != test.want {
+				t.Errorf("Verdict() = %s, want %s", got, test.want)
+			}
+		})
+	}
+}
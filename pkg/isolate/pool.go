@@ -0,0 +1,266 @@
+package isolate
+
+import (
+	"errors"
+	"sync"
+
+	"golang.org/x/exp/slog"
+)
+
+var ErrPoolClosed = errors.New("box pool is closed")
+
+// ErrBoxNotInUse is returned when a box is released that the pool didn't
+// hand out or that was already released.
+var ErrBoxNotInUse = errors.New("box is not in use by the pool")
+
+// boxSource initializes and erases the boxes of a pool, an *Isolate.
+type boxSource interface {
+	NewBox() (*IsolateBox, error)
+	EraseBox(boxId int) error
+}
+
+type BoxPoolStats struct {
+	// Idle boxes are initialized and waiting to be acquired.
+	Idle int
+	// InUse boxes have been acquired and not yet released.
+	InUse int
+	// Warm is the number of idle boxes the pool tries to keep.
+	Warm int
+	// Max caps Idle + InUse.
+	Max int
+	// Acquired counts every successful Acquire call.
+	Acquired int64
+	// Hits counts acquisitions served by an already initialized box.
+	Hits int64
+	// Misses counts acquisitions that had to wait for a box to initialize.
+	Misses int64
+	// Created counts boxes initialized by the pool.
+	Created int64
+	// Discarded counts boxes erased because they could not be reset.
+	Discarded int64
+}
+
+// BoxPool keeps a number of isolate boxes initialized ahead of time so
+// that a job doesn't have to wait for `isolate --init`. Boxes are handed
+// back with Release (or IsolateBox.Close) and reused once their contents
+// have been wiped.
+type BoxPool struct {
+	isolate boxSource
+	warm    int
+	max     int
+
+	mutex sync.Mutex
+	cond  *sync.Cond
+	idle  []*IsolateBox
+	// inUse holds the acquired boxes
+	inUse map[*IsolateBox]bool
+	// pending counts boxes being initialized and resetting those being
+	// reset outside of the mutex
+	pending   int
+	resetting int
+	closed    bool
+	stats     BoxPoolStats
+	logger    *slog.Logger
+}
+
+// NewBoxPool initializes warm boxes right away and never lets the total
+// number of boxes exceed max.
+func NewBoxPool(isolate *Isolate, warm int, max int) (*BoxPool, error) {
+	return newBoxPool(isolate, warm, max)
+}
+
+func newBoxPool(source boxSource, warm int, max int) (*BoxPool, error) {
+	if warm < 0 || max < 1 || warm > max {
+		return nil, errors.New("box pool needs 0 <= warm <= max and max >= 1")
+	}
+
+	pool := &BoxPool{
+		isolate: source,
+		warm:    warm,
+		max:     max,
+		inUse:   make(map[*IsolateBox]bool),
+		logger:  slog.With(slog.Int("pool-warm", warm), slog.Int("pool-max", max)),
+	}
+	pool.cond = sync.NewCond(&pool.mutex)
+
+	for i := 0; i < warm; i++ {
+		box, err := pool.createBox()
+		if err != nil {
+			pool.Close()
+			return nil, err
+		}
+		pool.idle = append(pool.idle, box)
+	}
+
+	pool.logger.Info("initialized box pool")
+	return pool, nil
+}
+
+// Acquire returns an idle box or initializes a new one. When the pool
+// already holds max boxes it blocks until one is released.
+func (pool *BoxPool) Acquire() (*IsolateBox, error) {
+	pool.mutex.Lock()
+	for {
+		if pool.closed {
+			pool.mutex.Unlock()
+			return nil, ErrPoolClosed
+		}
+		if len(pool.idle) > 0 {
+			box := pool.idle[len(pool.idle)-1]
+			pool.idle = pool.idle[:len(pool.idle)-1]
+			pool.inUse[box] = true
+			pool.stats.Acquired++
+			pool.stats.Hits++
+			pool.mutex.Unlock()
+			pool.refill()
+			return box, nil
+		}
+		if pool.total() < pool.max {
+			break
+		}
+		pool.cond.Wait()
+	}
+	pool.pending++
+	pool.mutex.Unlock()
+
+	box, err := pool.createBox()
+
+	pool.mutex.Lock()
+	pool.pending--
+	if err != nil {
+		pool.cond.Signal()
+		pool.mutex.Unlock()
+		return nil, err
+	}
+	pool.inUse[box] = true
+	pool.stats.Acquired++
+	pool.stats.Misses++
+	pool.mutex.Unlock()
+	return box, nil
+}
+
+// Release wipes the box and makes it available again. A box that can't
+// be reset is erased instead, freeing its slot for a fresh one. Releasing
+// a box again fails with ErrBoxNotInUse and leaves it alone.
+func (pool *BoxPool) Release(box *IsolateBox) error {
+	pool.mutex.Lock()
+	if !pool.inUse[box] {
+		pool.mutex.Unlock()
+		return ErrBoxNotInUse
+	}
+	delete(pool.inUse, box)
+	pool.resetting++
+	pool.mutex.Unlock()
+
+	resetErr := box.Reset()
+
+	pool.mutex.Lock()
+	pool.resetting--
+	if resetErr == nil && !pool.closed {
+		pool.idle = append(pool.idle, box)
+		pool.cond.Signal()
+		pool.mutex.Unlock()
+		return nil
+	}
+	if resetErr != nil {
+		pool.stats.Discarded++
+	}
+	pool.cond.Signal()
+	pool.mutex.Unlock()
+
+	if resetErr != nil {
+		box.logger.Warn("discarding box that failed to reset",
+			slog.String("error", resetErr.Error()))
+	}
+	err := pool.isolate.EraseBox(box.id)
+	if resetErr != nil {
+		pool.refill()
+	}
+	return err
+}
+
+func (pool *BoxPool) Stats() BoxPoolStats {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	stats := pool.stats
+	stats.Idle = len(pool.idle)
+	stats.InUse = len(pool.inUse)
+	stats.Warm = pool.warm
+	stats.Max = pool.max
+	return stats
+}
+
+// Close erases the idle boxes. Boxes still in use are erased when released.
+func (pool *BoxPool) Close() error {
+	pool.mutex.Lock()
+	pool.closed = true
+	idle := pool.idle
+	pool.idle = nil
+	pool.cond.Broadcast()
+	pool.mutex.Unlock()
+
+	var firstErr error
+	for _, box := range idle {
+		err := pool.isolate.EraseBox(box.id)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// total must be called with the mutex held.
+func (pool *BoxPool) total() int {
+	return len(pool.idle) + len(pool.inUse) + pool.pending + pool.resetting
+}
+
+// refill initializes boxes in the background until warm of them are idle.
+func (pool *BoxPool) refill() {
+	pool.mutex.Lock()
+	missing := pool.warm - len(pool.idle) - pool.pending
+	if room := pool.max - pool.total(); missing > room {
+		missing = room
+	}
+	if pool.closed || missing <= 0 {
+		pool.mutex.Unlock()
+		return
+	}
+	pool.pending += missing
+	pool.mutex.Unlock()
+
+	for i := 0; i < missing; i++ {
+		go func() {
+			box, err := pool.createBox()
+
+			pool.mutex.Lock()
+			defer pool.mutex.Unlock()
+			pool.pending--
+			if err != nil {
+				pool.logger.Error("failed to initialize box",
+					slog.String("error", err.Error()))
+				pool.cond.Signal()
+				return
+			}
+			if pool.closed {
+				go pool.isolate.EraseBox(box.id)
+				return
+			}
+			pool.idle = append(pool.idle, box)
+			pool.cond.Signal()
+		}()
+	}
+}
+
+func (pool *BoxPool) createBox() (*IsolateBox, error) {
+	box, err := pool.isolate.NewBox()
+	if err != nil {
+		return nil, err
+	}
+	box.pool = pool
+
+	pool.mutex.Lock()
+	pool.stats.Created++
+	pool.mutex.Unlock()
+	return box, nil
+}
@@ -0,0 +1,230 @@
+package isolate
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeBoxSource hands out boxes that are plain directories.
+type fakeBoxSource struct {
+	dir string
+
+	mutex  sync.Mutex
+	nextId int
+	erased []int
+}
+
+func (source *fakeBoxSource) NewBox() (*IsolateBox, error) {
+	source.mutex.Lock()
+	id := source.nextId
+	source.nextId++
+	source.mutex.Unlock()
+
+	path := filepath.Join(source.dir, fmt.Sprint(id))
+	if err := os.MkdirAll(filepath.Join(path, "box"), 0755); err != nil {
+		return nil, err
+	}
+	return NewIsolateBox(nil, id, path), nil
+}
+
+func (source *fakeBoxSource) EraseBox(boxId int) error {
+	source.mutex.Lock()
+	defer source.mutex.Unlock()
+	source.erased = append(source.erased, boxId)
+	return nil
+}
+
+func (source *fakeBoxSource) Erased() []int {
+	source.mutex.Lock()
+	defer source.mutex.Unlock()
+	return append([]int(nil), source.erased...)
+}
+
+func newTestPool(t *testing.T, warm int, max int) (*BoxPool, *fakeBoxSource) {
+	t.Helper()
+	source := &fakeBoxSource{dir: t.TempDir()}
+	pool, err := newBoxPool(source, warm, max)
+	if err != nil {
+		t.Fatalf("newBoxPool() error = %v", err)
+	}
+	return pool, source
+}
+
+// waitFor polls until the pool's stats satisfy cond.
+func waitFor(t *testing.T, pool *BoxPool, cond func(stats BoxPoolStats) bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond(pool.Stats()) {
+		if time.Now().After(deadline) {
+			t.Fatalf("stats = %+v, condition not met", pool.Stats())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestBoxPoolCap(t *testing.T) {
+	pool, _ := newTestPool(t, 0, 2)
+	first, err := pool.Acquire()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pool.Acquire(); err != nil {
+		t.Fatal(err)
+	}
+
+	acquired := make(chan *IsolateBox)
+	go func() {
+		box, err := pool.Acquire()
+		if err != nil {
+			t.Error(err)
+		}
+		acquired <- box
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("Acquire went past the cap")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if err := first.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case box := <-acquired:
+		if box != first {
+			t.Errorf("got box %d, want the released box %d", box.Id(), first.Id())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Acquire didn't get the released box")
+	}
+	if stats := pool.Stats(); stats.InUse != 2 || stats.Created != 2 || stats.Hits != 1 || stats.Misses != 2 {
+		t.Errorf("stats = %+v", stats)
+	}
+}
+
+func TestBoxPoolRefill(t *testing.T) {
+	pool, _ := newTestPool(t, 2, 3)
+	if stats := pool.Stats(); stats.Idle != 2 || stats.Created != 2 {
+		t.Fatalf("stats after start = %+v, want 2 idle boxes", stats)
+	}
+
+	if _, err := pool.Acquire(); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, pool, func(stats BoxPoolStats) bool { return stats.Idle == 2 })
+
+	// the refill stops at the cap
+	if _, err := pool.Acquire(); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, pool, func(stats BoxPoolStats) bool { return stats.Idle == 1 && stats.InUse == 2 })
+	time.Sleep(20 * time.Millisecond)
+	if stats := pool.Stats(); stats.Created != 3 || stats.Idle+stats.InUse != 3 {
+		t.Errorf("stats = %+v, want 3 boxes in all", stats)
+	}
+}
+
+func TestBoxPoolDoubleRelease(t *testing.T) {
+	pool, _ := newTestPool(t, 0, 1)
+	box, err := pool.Acquire()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := box.AddFile("left", []byte("behind")); err != nil {
+		t.Fatal(err)
+	}
+	if err := box.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := box.Close(); !errors.Is(err, ErrBoxNotInUse) {
+		t.Errorf("second Close() error = %v, want ErrBoxNotInUse", err)
+	}
+	if stats := pool.Stats(); stats.InUse != 0 || stats.Idle != 1 {
+		t.Errorf("stats = %+v, want the box idle once", stats)
+	}
+
+	again, err := pool.Acquire()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if files, _ := again.ListFiles(); len(files) != 0 {
+		t.Errorf("reused box holds %v, want it reset", files)
+	}
+}
+
+func TestBoxPoolConcurrent(t *testing.T) {
+	const max = 3
+	pool, _ := newTestPool(t, 1, max)
+	var mutex sync.Mutex
+	held, peak := 0, 0
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			box, err := pool.Acquire()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			mutex.Lock()
+			held++
+			if held > peak {
+				peak = held
+			}
+			mutex.Unlock()
+			time.Sleep(time.Millisecond)
+			mutex.Lock()
+			held--
+			mutex.Unlock()
+			if err := box.Close(); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if peak > max {
+		t.Errorf("%d boxes held at once, want at most %d", peak, max)
+	}
+	stats := pool.Stats()
+	if stats.InUse != 0 || stats.Acquired != 20 || stats.Idle > max || stats.Created > max {
+		t.Errorf("stats = %+v", stats)
+	}
+}
+
+func TestBoxPoolClose(t *testing.T) {
+	pool, source := newTestPool(t, 2, 2)
+	box, err := pool.Acquire()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pool.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := pool.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pool.Acquire(); !errors.Is(err, ErrPoolClosed) {
+		t.Errorf("Acquire() after Close error = %v, want ErrPoolClosed", err)
+	}
+	if erased := source.Erased(); len(erased) != 1 {
+		t.Errorf("erased %v, want the idle box", erased)
+	}
+
+	// a box in use is erased once it's released
+	if err := box.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if erased := source.Erased(); len(erased) != 2 || erased[1] != box.Id() {
+		t.Errorf("erased %v, want box %d last", erased, box.Id())
+	}
+	if stats := pool.Stats(); stats.InUse != 0 || stats.Idle != 0 {
+		t.Errorf("stats = %+v, want no boxes", stats)
+	}
+}
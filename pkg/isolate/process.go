@@ -2,11 +2,16 @@ package isolate
 
 import (
 	"bufio"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"os/exec"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"golang.org/x/exp/slog"
 )
@@ -45,95 +50,238 @@ message:Time limit exceeded
 */
 
 type IsolateMetrics struct {
-    TimeSec float64
-    TimeWallSec float64
-    MaxRssKb int64
-    CswVoluntary int64
-    CswForced int64
-    CgMemKb int64
-    ExitCode int64
-    Status string
-    Message string
+	TimeSec      float64
+	TimeWallSec  float64
+	MaxRssKb     int64
+	CswVoluntary int64
+	CswForced    int64
+	CgMemKb      int64
+	CgEnabled    bool
+	CgOomKilled  bool
+	Killed       bool
+	ExitCode     int64
+	ExitSig      int64
+	Status       string
+	Message      string
+	// Extra holds meta file keys not covered by the fields above.
+	Extra map[string]string
+	// Env is the environment the command was started with as NAME=value
+	// pairs. With full_env it holds the runner's whole environment, and
+	// literal values are copied as they are, so it may hold secrets such as
+	// tokens; the runner only ever logs the names.
+	Env []string
+	// Cancelled is set when the run was stopped through its context or Kill.
+	Cancelled bool
+	// OutputLimitExceeded is set by the caller that killed the run for
+	// writing too much output, isolate itself doesn't limit it.
+	OutputLimitExceeded bool
 }
 
+// MemoryKb is the memory use of the run: that of the whole control group
+// when cgroups were enabled, otherwise the peak resident set size of the
+// largest process.
+func (metrics *IsolateMetrics) MemoryKb() int64 {
+	if metrics.CgEnabled {
+		return metrics.CgMemKb
+	}
+	return metrics.MaxRssKb
+}
+
+// WeakAccounting reports that the run went without cgroups. Its memory
+// use misses child processes and memory not resident, and memory limit
+// violations show up as runtime errors rather than VerdictML.
+func (metrics *IsolateMetrics) WeakAccounting() bool {
+	return !metrics.CgEnabled
+}
+
+// killGracePeriod is how long isolate gets to tear the box down after
+// SIGTERM before it is killed outright.
+const killGracePeriod = time.Second
+
 type IsolateProcess struct {
 	cmd          *exec.Cmd
+	stdin        io.ReadCloser
 	stdout       io.ReadCloser
 	stderr       io.ReadCloser
 	metaFilePath string
+	env          []string
+
+	isolate *Isolate
+	boxId   int
+	cancel  context.CancelFunc
+	// exited is closed once isolate exited, waitErr is what cmd.Wait
+	// returned then.
+	exited  chan struct{}
+	waitErr error
+	// mutex orders watch's kill against Wait reading cancelled, set when
+	// the kill interrupted a live process.
+	mutex     sync.Mutex
+	cancelled bool
+}
+
+// watch kills the process once ctx is done. Isolate handles SIGTERM by
+// killing everything in the box, SIGKILL is the fallback for a keeper that
+// doesn't exit in time. A process that already exited isn't cancelled,
+// whether or not Wait was called yet.
+func (process *IsolateProcess) watch(ctx context.Context) {
+	select {
+	case <-process.exited:
+		return
+	case <-ctx.Done():
+	}
+	if !process.interrupt() {
+		return
+	}
+	slog.Info("killing cancelled isolate command", slog.Int("box-id", process.boxId))
+
+	select {
+	case <-process.exited:
+	case <-time.After(killGracePeriod):
+		process.cmd.Process.Kill()
+	}
+}
+
+// interrupt sends isolate SIGTERM unless it already exited, telling
+// whether it did.
+func (process *IsolateProcess) interrupt() bool {
+	process.mutex.Lock()
+	defer process.mutex.Unlock()
+	select {
+	case <-process.exited:
+		return false
+	default:
+	}
+	// fails once the process was reaped, nothing was interrupted then
+	if err := process.cmd.Process.Signal(syscall.SIGTERM); err != nil {
+		return false
+	}
+	process.cancelled = true
+	return true
+}
+
+// Kill stops the process as if its context was cancelled.
+func (process *IsolateProcess) Kill() {
+	process.cancel()
 }
 
+// Wait blocks until the command exits and returns its metrics. If the
+// run was cancelled the box is cleaned up, as the sandbox may have been
+// killed midway, and the metrics carry VerdictCancelled.
 func (process *IsolateProcess) Wait() (*IsolateMetrics, error) {
-	err := process.cmd.Wait()
+	// isolate exits with a non-zero status whenever the sandboxed program
+	// fails, the meta file tells whether that was the program or isolate
+	<-process.exited
+	waitErr := process.waitErr
+	process.cancel()
+	process.stdout.Close()
+	process.stderr.Close()
+	if process.stdin != nil {
+		process.stdin.Close()
+	}
+
+	process.mutex.Lock()
+	cancelled := process.cancelled
+	process.mutex.Unlock()
+	if cancelled {
+		return process.waitCancelled()
+	}
+
+	var exitErr *exec.ExitError
+	if waitErr != nil && !errors.As(waitErr, &exitErr) {
+		os.Remove(process.metaFilePath)
+		return nil, waitErr
+	}
+
+	content, err := os.ReadFile(process.metaFilePath)
+	os.Remove(process.metaFilePath)
+	if err != nil {
+		return nil, err
+	}
+
+	slog.Info("meta file content", slog.String("content", string(content)))
+
+	metrics, err := ParseMetaFile(content)
+	if err != nil {
+		slog.Info("invalid meta file", slog.String("error", err.Error()))
+		return nil, err
+	}
+	if waitErr != nil && metrics.Status == "" {
+		return nil, waitErr
+	}
+	metrics.Env = process.env
+	metrics.CgEnabled = process.isolate.config.UseCgroups
+
+	slog.Info("metrics",
+		slog.Float64("time", metrics.TimeSec),
+		slog.Float64("time-wall", metrics.TimeWallSec),
+		slog.Int64("max-rss", metrics.MaxRssKb),
+		slog.Int64("csw-voluntary", metrics.CswVoluntary),
+		slog.Int64("csw-forced", metrics.CswForced),
+		slog.Int64("cg-mem", metrics.CgMemKb),
+		slog.Bool("cg-enabled", metrics.CgEnabled),
+		slog.Bool("cg-oom-killed", metrics.CgOomKilled),
+		slog.Int64("memory", metrics.MemoryKb()),
+		slog.Bool("weak-accounting", metrics.WeakAccounting()),
+		slog.Bool("killed", metrics.Killed),
+		slog.Int64("exitcode", metrics.ExitCode),
+		slog.Int64("exitsig", metrics.ExitSig),
+		slog.String("status", metrics.Status),
+		slog.String("message", metrics.Message),
+		slog.String("verdict", string(metrics.Verdict())),
+		slog.String("env", strings.Join(EnvNames(metrics.Env), " ")))
+
+	return metrics, nil
+}
+
+func (process *IsolateProcess) waitCancelled() (*IsolateMetrics, error) {
+	// whatever isolate managed to write before it was stopped
+	metrics := &IsolateMetrics{}
+	content, err := os.ReadFile(process.metaFilePath)
+	os.Remove(process.metaFilePath)
+	if err == nil {
+		if parsed, err := ParseMetaFile(content); err == nil {
+			metrics = parsed
+		}
+	}
+	metrics.Cancelled = true
+	metrics.Env = process.env
+	metrics.CgEnabled = process.isolate.config.UseCgroups
+
+	out, err := process.isolate.cleanupBox(process.boxId)
+	slog.Info("cleaned up box of cancelled command", slog.Int("box-id", process.boxId),
+		slog.String("output", string(out)))
 	if err != nil {
 		return nil, err
 	}
-    // read metaFilePaht
-    content, err := os.ReadFile(process.metaFilePath)
-    if err != nil {
-        return nil, err
-    }
-   
-    slog.Info("meta file content", slog.String("content", string(content)))
-
-    // parse metrics
-    lines := strings.Split(string(content), "\n")
-    metrics := &IsolateMetrics{}
-
-    for _, line := range lines {
-        if line == "" {
-            continue
-        }
-
-        parts := strings.Split(line, ":")
-        if len(parts) != 2 {
-            slog.Info("invalid meta file line", slog.String("line", line))
-            return nil, fmt.Errorf("invalid meta file line: %s", line)
-        }
-        
-        key := parts[0]
-        value := parts[1]
-
-        switch key {
-        case "time":
-            fmt.Sscanf(value, "%f", &metrics.TimeSec)
-        case "time-wall":
-            fmt.Sscanf(value, "%f", &metrics.TimeWallSec)
-        case "max-rss":
-            fmt.Sscanf(value, "%d", &metrics.MaxRssKb)
-        case "csw-voluntary":
-            fmt.Sscanf(value, "%d", &metrics.CswVoluntary)
-        case "csw-forced":
-            fmt.Sscanf(value, "%d", &metrics.CswForced)
-        case "cg-mem":
-            fmt.Sscanf(value, "%d", &metrics.CgMemKb)
-        case "exitcode":
-            fmt.Sscanf(value, "%d", &metrics.ExitCode)
-        case "status":
-            metrics.Status = value
-        case "message":
-            metrics.Message = value
-        case "":
-            // ignore
-        default:
-            slog.Info("unknown meta file line", slog.String("line", line))
-        }
-    }
-
-    slog.Info("metrics",
-        slog.Float64("time", metrics.TimeSec),
-        slog.Float64("time-wall", metrics.TimeWallSec),
-        slog.Int64("max-rss", metrics.MaxRssKb),
-        slog.Int64("csw-voluntary", metrics.CswVoluntary),
-        slog.Int64("csw-forced", metrics.CswForced),
-        slog.Int64("cg-mem", metrics.CgMemKb),
-        slog.Int64("exitcode", metrics.ExitCode),
-        slog.String("status", metrics.Status),
-        slog.String("message", metrics.Message))
-    
 	return metrics, nil
 }
 
+// stdinChunkSize is the most CopyStdin forwards at once.
+const stdinChunkSize = 32 * 1024
+
+// CopyStdin forwards src to the stdin of a process chunk by chunk, as soon
+// as each one arrives, rather than waiting to fill a buffer. It closes dst
+// when src ends so that the process sees EOF, and stops early once the
+// process no longer reads its stdin.
+//
+// Unlike exec.Cmd.Stdin the copy doesn't hold up exec.Cmd.Wait, which
+// matters for a src that stays open while the process runs.
+func CopyStdin(dst io.WriteCloser, src io.Reader) {
+	defer dst.Close()
+	buf := make([]byte, stdinChunkSize)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			if _, writeErr := dst.Write(buf[:n]); writeErr != nil {
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
 func (process *IsolateProcess) LogOutput() {
 	stdoutScanner := bufio.NewScanner(process.Stdout())
 	stderrScanner := bufio.NewScanner(process.Stderr())
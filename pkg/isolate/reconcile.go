@@ -0,0 +1,126 @@
+package isolate
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+// isolateConfigPaths are the locations `make install` and distribution
+// packages put isolate's configuration file at.
+var isolateConfigPaths = []string{"/usr/local/etc/isolate", "/etc/isolate"}
+
+const defaultBoxRoot = "/var/local/lib/isolate"
+
+type ReconcileReport struct {
+	// CleanedBoxes lists the orphaned boxes that were cleaned up.
+	CleanedBoxes []int
+	// RemovedMetaFiles lists the deleted meta files.
+	RemovedMetaFiles []string
+	// Errors describes what could not be cleaned up.
+	Errors []string
+}
+
+// BoxRoot returns the directory isolate keeps its boxes in, as configured
+// in IsolateConfig or else in isolate's own configuration file.
+func (isolate *Isolate) BoxRoot() string {
+	if isolate.config.BoxRoot != "" {
+		return isolate.config.BoxRoot
+	}
+	for _, path := range isolateConfigPaths {
+		root, err := readBoxRoot(path)
+		if err == nil && root != "" {
+			return root
+		}
+	}
+	return defaultBoxRoot
+}
+
+func readBoxRoot(configPath string) (string, error) {
+	file, err := os.Open(configPath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		key, value, found := strings.Cut(line, "=")
+		if found && strings.TrimSpace(key) == "box_root" {
+			return strings.TrimSpace(value), nil
+		}
+	}
+	return "", scanner.Err()
+}
+
+// Reconcile cleans up after runners that exited without erasing their
+// boxes. Every box in the configured id range that exists under the box
+// root and isn't locked by a live runner gets `isolate --cleanup`, and meta
+// files older than IsolateConfig.MetaFileMaxAge are deleted.
+func (isolate *Isolate) Reconcile() *ReconcileReport {
+	report := &ReconcileReport{}
+	boxRoot := isolate.BoxRoot()
+
+	isolate.mutex.Lock()
+	for boxId := isolate.config.MinBoxId; boxId <= isolate.config.MaxBoxId; boxId++ {
+		if isolate.idsInUse[boxId] != nil {
+			continue
+		}
+		_, err := os.Stat(filepath.Join(boxRoot, strconv.Itoa(boxId)))
+		if err != nil {
+			continue
+		}
+
+		lock, _, err := TryLockBoxId(isolate.config.LockDir, boxId)
+		if err != nil {
+			report.Errors = append(report.Errors, err.Error())
+			continue
+		}
+		if lock == nil {
+			// a live runner is using it
+			continue
+		}
+
+		out, err := isolate.cleanupBox(boxId)
+		lock.Release()
+		if err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("box %d: %s: %s",
+				boxId, err.Error(), strings.TrimSpace(string(out))))
+			continue
+		}
+		report.CleanedBoxes = append(report.CleanedBoxes, boxId)
+	}
+	isolate.mutex.Unlock()
+
+	metaFiles, err := filepath.Glob(filepath.Join(isolate.metaDir(), metaFilePattern))
+	if err != nil {
+		report.Errors = append(report.Errors, err.Error())
+	}
+	for _, path := range metaFiles {
+		info, err := os.Stat(path)
+		if err != nil || time.Since(info.ModTime()) < isolate.config.MetaFileMaxAge {
+			continue
+		}
+		err = os.Remove(path)
+		if err != nil {
+			report.Errors = append(report.Errors, err.Error())
+			continue
+		}
+		report.RemovedMetaFiles = append(report.RemovedMetaFiles, path)
+	}
+
+	slog.Info("reconciled isolate boxes",
+		slog.String("box-root", boxRoot),
+		slog.Int("cleaned-boxes", len(report.CleanedBoxes)),
+		slog.Int("removed-meta-files", len(report.RemovedMetaFiles)),
+		slog.Int("errors", len(report.Errors)))
+
+	return report
+}
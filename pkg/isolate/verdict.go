@@ -0,0 +1,54 @@
+package isolate
+
+// Verdict is the outcome of a sandboxed run derived from isolate's meta file.
+type Verdict string
+
+const (
+	// VerdictOK means the program exited normally with exit code 0.
+	VerdictOK Verdict = "OK"
+	// VerdictRE means the program exited with a non-zero exit code.
+	VerdictRE Verdict = "RE"
+	// VerdictSG means the program died on a signal.
+	VerdictSG Verdict = "SG"
+	// VerdictTO means the program exceeded the cpu or wall time limit.
+	VerdictTO Verdict = "TO"
+	// VerdictML means the program was killed by the out-of-memory killer.
+	VerdictML Verdict = "ML"
+	// VerdictXX means the sandbox itself failed.
+	VerdictXX Verdict = "XX"
+	// VerdictOLE means the program was killed for writing more output than
+	// allowed.
+	VerdictOLE Verdict = "OLE"
+	// VerdictCancelled means the run was killed on request of the caller.
+	VerdictCancelled Verdict = "CANCELLED"
+)
+
+// Verdict classifies the run. An out-of-memory kill takes precedence over
+// the status isolate reports, as such a process usually shows up as SG.
+// Exceeding the output limit comes first, the runner kills such a process.
+func (metrics *IsolateMetrics) Verdict() Verdict {
+	if metrics.OutputLimitExceeded {
+		return VerdictOLE
+	}
+	if metrics.Cancelled {
+		return VerdictCancelled
+	}
+	if metrics.CgOomKilled {
+		return VerdictML
+	}
+	switch metrics.Status {
+	case "":
+		if metrics.ExitCode != 0 {
+			return VerdictRE
+		}
+		return VerdictOK
+	case "RE":
+		return VerdictRE
+	case "SG":
+		return VerdictSG
+	case "TO":
+		return VerdictTO
+	default:
+		return VerdictXX
+	}
+}
@@ -0,0 +1,363 @@
+// Package fake is an in-process sandbox.Sandbox for tests. Boxes are
+// temporary directories and commands either run unsandboxed on the host
+// or have their outcome scripted by the test.
+package fake
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/programme-lv/runner/pkg/isolate"
+	"github.com/programme-lv/runner/pkg/sandbox"
+)
+
+// Call records a command started in a fake box.
+type Call struct {
+	BoxId   int
+	Command string
+	Options isolate.RunOptions
+}
+
+// Result scripts the outcome of a command instead of running it.
+type Result struct {
+	Stdout string
+	Stderr string
+	// Metrics are returned by Wait. When nil they are made up from the
+	// exit code, zero meaning VerdictOK.
+	Metrics  *isolate.IsolateMetrics
+	ExitCode int64
+	// StartErr is returned by Run, WaitErr by Wait.
+	StartErr error
+	WaitErr  error
+	// Duration keeps the process running for a while; cancelling the
+	// context or Kill ends it early with VerdictCancelled and, as with
+	// isolate, wipes the box.
+	Duration time.Duration
+	// Files are written into the box before Wait returns, e.g. the
+	// executable a compiler would produce.
+	Files map[string][]byte
+}
+
+type Sandbox struct {
+	// Script decides the outcome of every command. Returning nil, as well
+	// as leaving Script nil, runs the command on the host in the box dir.
+	Script func(call Call) *Result
+	// NewBoxErr makes NewBox fail.
+	NewBoxErr error
+
+	mutex  sync.Mutex
+	nextId int
+	calls  []Call
+	open   map[int]bool
+}
+
+func NewSandbox() *Sandbox {
+	return &Sandbox{open: make(map[int]bool)}
+}
+
+func (s *Sandbox) NewBox() (sandbox.Box, error) {
+	if s.NewBoxErr != nil {
+		return nil, s.NewBoxErr
+	}
+
+	dir, err := os.MkdirTemp("", "fake-box-*")
+	if err != nil {
+		return nil, err
+	}
+	err = os.Mkdir(filepath.Join(dir, "box"), 0755)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+
+	s.mutex.Lock()
+	id := s.nextId
+	s.nextId++
+	if s.open == nil {
+		s.open = make(map[int]bool)
+	}
+	s.open[id] = true
+	s.mutex.Unlock()
+
+	// the isolate box is only used for its file operations
+	return &Box{IsolateBox: isolate.NewIsolateBox(nil, id, dir), sandbox: s}, nil
+}
+
+// Calls returns the commands run so far, in order.
+func (s *Sandbox) Calls() []Call {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]Call(nil), s.calls...)
+}
+
+// OpenBoxes returns the number of boxes that haven't been closed.
+func (s *Sandbox) OpenBoxes() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.open)
+}
+
+type Box struct {
+	*isolate.IsolateBox
+	sandbox *Sandbox
+}
+
+func (box *Box) Run(ctx context.Context, command string, stdin io.ReadCloser,
+	options *isolate.RunOptions) (sandbox.Process, error) {
+	call := Call{BoxId: box.Id(), Command: command}
+	if options != nil {
+		call.Options = *options
+	}
+
+	box.sandbox.mutex.Lock()
+	box.sandbox.calls = append(box.sandbox.calls, call)
+	script := box.sandbox.Script
+	box.sandbox.mutex.Unlock()
+
+	if script != nil {
+		if result := script(call); result != nil {
+			return box.runScripted(ctx, stdin, result)
+		}
+	}
+	return box.runOnHost(ctx, command, stdin, call.Options)
+}
+
+// wipe removes the box like the cleanup isolate does after a cancelled
+// run, later runs in it fail.
+func (box *Box) wipe() {
+	os.RemoveAll(box.Path())
+}
+
+func (box *Box) Close() error {
+	box.sandbox.mutex.Lock()
+	delete(box.sandbox.open, box.Id())
+	box.sandbox.mutex.Unlock()
+	return os.RemoveAll(box.Path())
+}
+
+func (box *Box) runScripted(ctx context.Context, stdin io.ReadCloser,
+	result *Result) (sandbox.Process, error) {
+	if result.StartErr != nil {
+		return nil, result.StartErr
+	}
+	if stdin != nil {
+		go func() {
+			io.Copy(io.Discard, stdin)
+			stdin.Close()
+		}()
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	return &scriptedProcess{
+		box:    box,
+		result: result,
+		ctx:    ctx,
+		cancel: cancel,
+		stdout: io.NopCloser(strings.NewReader(result.Stdout)),
+		stderr: io.NopCloser(strings.NewReader(result.Stderr)),
+	}, nil
+}
+
+type scriptedProcess struct {
+	box    *Box
+	result *Result
+	ctx    context.Context
+	cancel context.CancelFunc
+	stdout io.ReadCloser
+	stderr io.ReadCloser
+}
+
+func (p *scriptedProcess) Stdout() io.ReadCloser { return p.stdout }
+func (p *scriptedProcess) Stderr() io.ReadCloser { return p.stderr }
+func (p *scriptedProcess) Kill()                 { p.cancel() }
+
+func (p *scriptedProcess) Wait() (*isolate.IsolateMetrics, error) {
+	defer p.cancel()
+
+	timer := time.NewTimer(p.result.Duration)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-p.ctx.Done():
+		p.box.wipe()
+		return &isolate.IsolateMetrics{Cancelled: true}, nil
+	}
+
+	for path, content := range p.result.Files {
+		if err := p.box.AddFileWithMode(path, content, 0755); err != nil {
+			return nil, err
+		}
+	}
+	if p.result.WaitErr != nil {
+		return nil, p.result.WaitErr
+	}
+	if p.result.Metrics != nil {
+		metrics := *p.result.Metrics
+		return &metrics, nil
+	}
+	return exitMetrics(p.result.ExitCode, p.result.Duration.Seconds()), nil
+}
+
+func exitMetrics(exitCode int64, wallTimeSec float64) *isolate.IsolateMetrics {
+	metrics := &isolate.IsolateMetrics{
+		TimeWallSec: wallTimeSec,
+		ExitCode:    exitCode,
+	}
+	if exitCode != 0 {
+		metrics.Status = "RE"
+	}
+	return metrics
+}
+
+func (box *Box) runOnHost(ctx context.Context, command string, stdin io.ReadCloser,
+	options isolate.RunOptions) (sandbox.Process, error) {
+	argv, err := isolate.SplitCommand(command)
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := exec.Command(argv[0], argv[1:]...)
+	cmd.Dir = filepath.Join(box.Path(), "box")
+	env := isolate.DefaultEnvironment().Merge(options.Env)
+	env.Set["HOME"] = cmd.Dir
+	cmd.Env = append(os.Environ(), env.Resolve()...)
+	process := &hostProcess{box: box, cmd: cmd, stdin: stdin, exited: make(chan struct{})}
+	var stdinPipe io.WriteCloser
+	if stdin != nil {
+		stdinPipe, err = cmd.StdinPipe()
+		if err != nil {
+			return nil, err
+		}
+	}
+	// plain pipes, like isolate's, so that the exit is noticed while the
+	// output is still being read
+	stdoutRead, stdoutWrite, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	stderrRead, stderrWrite, err := os.Pipe()
+	if err != nil {
+		stdoutRead.Close()
+		stdoutWrite.Close()
+		return nil, err
+	}
+	cmd.Stdout, cmd.Stderr = stdoutWrite, stderrWrite
+	process.stdout, process.stderr = stdoutRead, stderrRead
+
+	process.start = time.Now()
+	err = cmd.Start()
+	stdoutWrite.Close()
+	stderrWrite.Close()
+	if err != nil {
+		stdoutRead.Close()
+		stderrRead.Close()
+		return nil, err
+	}
+
+	go func() {
+		process.waitErr = cmd.Wait()
+		process.mutex.Lock()
+		process.end = time.Now()
+		close(process.exited)
+		process.mutex.Unlock()
+	}()
+	if stdin != nil {
+		go isolate.CopyStdin(stdinPipe, stdin)
+	}
+	ctx, process.cancel = context.WithCancel(ctx)
+	go process.watch(ctx)
+	return process, nil
+}
+
+type hostProcess struct {
+	box    *Box
+	cmd    *exec.Cmd
+	cancel context.CancelFunc
+	stdin  io.ReadCloser
+	stdout io.ReadCloser
+	stderr io.ReadCloser
+	start  time.Time
+	// exited is closed once the command was reaped, waitErr is what
+	// cmd.Wait returned and end when that happened.
+	exited  chan struct{}
+	waitErr error
+	end     time.Time
+
+	// mutex orders watch's kill against the exit, cancelled is only set
+	// when the kill stopped a live command.
+	mutex     sync.Mutex
+	cancelled bool
+}
+
+func (p *hostProcess) Stdout() io.ReadCloser { return p.stdout }
+func (p *hostProcess) Stderr() io.ReadCloser { return p.stderr }
+func (p *hostProcess) Kill()                 { p.cancel() }
+
+// watch kills the command once ctx is done, unless it already exited.
+func (p *hostProcess) watch(ctx context.Context) {
+	select {
+	case <-p.exited:
+		return
+	case <-ctx.Done():
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	select {
+	case <-p.exited:
+		return
+	default:
+	}
+	if p.cmd.Process.Kill() == nil {
+		p.cancelled = true
+	}
+}
+
+func (p *hostProcess) Wait() (*isolate.IsolateMetrics, error) {
+	<-p.exited
+	err := p.waitErr
+	wall := p.end.Sub(p.start).Seconds()
+	p.cancel()
+	p.stdout.Close()
+	p.stderr.Close()
+	if p.stdin != nil {
+		p.stdin.Close()
+	}
+
+	p.mutex.Lock()
+	cancelled := p.cancelled
+	p.mutex.Unlock()
+	if cancelled {
+		p.box.wipe()
+		return &isolate.IsolateMetrics{Cancelled: true, TimeWallSec: wall}, nil
+	}
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		return nil, err
+	}
+
+	state := p.cmd.ProcessState
+	metrics := exitMetrics(int64(state.ExitCode()), wall)
+	metrics.TimeSec = (state.UserTime() + state.SystemTime()).Seconds()
+	if usage, ok := state.SysUsage().(*syscall.Rusage); ok {
+		metrics.MaxRssKb = usage.Maxrss
+		metrics.CswVoluntary = usage.Nvcsw
+		metrics.CswForced = usage.Nivcsw
+	}
+	if status, ok := state.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		metrics.Status = "SG"
+		metrics.ExitSig = int64(status.Signal())
+		metrics.ExitCode = 0
+	}
+	return metrics, nil
+}
+
+var _ sandbox.Sandbox = (*Sandbox)(nil)
+var _ sandbox.Box = (*Box)(nil)
@@ -0,0 +1,57 @@
+package sandbox
+
+import (
+	"context"
+	"io"
+
+	"github.com/programme-lv/runner/pkg/isolate"
+)
+
+type isolateSandbox struct {
+	isolate *isolate.Isolate
+}
+
+// NewIsolateSandbox creates a fresh isolate box for every NewBox call.
+func NewIsolateSandbox(isolate *isolate.Isolate) Sandbox {
+	return &isolateSandbox{isolate: isolate}
+}
+
+func (s *isolateSandbox) NewBox() (Box, error) {
+	box, err := s.isolate.NewBox()
+	if err != nil {
+		return nil, err
+	}
+	return &isolateBox{box}, nil
+}
+
+type poolSandbox struct {
+	pool *isolate.BoxPool
+}
+
+// NewPoolSandbox takes boxes from pool, closing a box returns it there.
+func NewPoolSandbox(pool *isolate.BoxPool) Sandbox {
+	return &poolSandbox{pool: pool}
+}
+
+func (s *poolSandbox) NewBox() (Box, error) {
+	box, err := s.pool.Acquire()
+	if err != nil {
+		return nil, err
+	}
+	return &isolateBox{box}, nil
+}
+
+type isolateBox struct {
+	*isolate.IsolateBox
+}
+
+func (box *isolateBox) Run(ctx context.Context, command string, stdin io.ReadCloser,
+	options *isolate.RunOptions) (Process, error) {
+	process, err := box.IsolateBox.Run(ctx, command, stdin, options)
+	if err != nil {
+		return nil, err
+	}
+	return process, nil
+}
+
+var _ Process = (*isolate.IsolateProcess)(nil)
@@ -0,0 +1,196 @@
+//go:build linux
+
+package native
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/programme-lv/runner/pkg/isolate"
+	"golang.org/x/exp/slog"
+)
+
+const cgroup2SuperMagic = 0x63677270
+
+// controllers are the cgroup v2 controllers every run cgroup needs.
+const controllers = "+cpu +memory +pids"
+
+// setupCgroupRoot creates root and delegates the controllers to it.
+func setupCgroupRoot(root string) error {
+	parent := filepath.Dir(root)
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(parent, &stat); err != nil {
+		return err
+	}
+	if stat.Type != cgroup2SuperMagic {
+		return fmt.Errorf("%s is not on a cgroup v2 filesystem", parent)
+	}
+
+	err := os.WriteFile(filepath.Join(parent, "cgroup.subtree_control"), []byte(controllers), 0)
+	if err != nil {
+		return fmt.Errorf("enabling cgroup controllers in %s: %w", parent, err)
+	}
+	err = os.Mkdir(root, 0755)
+	if err != nil && !errors.Is(err, fs.ErrExist) {
+		return err
+	}
+	err = os.WriteFile(filepath.Join(root, "cgroup.subtree_control"), []byte(controllers), 0)
+	if err != nil {
+		return fmt.Errorf("enabling cgroup controllers in %s: %w", root, err)
+	}
+	return nil
+}
+
+// initTasks is how many threads the sandbox init, which shares the cgroup
+// with the command, is allowed on top of the process limit.
+const initTasks = 8
+
+// cgroup is the cgroup of a single run.
+type cgroup struct {
+	path string
+}
+
+// removeStaleCgroup kills and removes a cgroup a crashed runner left
+// behind. Only the holder of the box id lock may call it.
+func removeStaleCgroup(root string, name string) error {
+	cg := &cgroup{path: filepath.Join(root, name)}
+	if _, err := os.Stat(cg.path); err != nil {
+		return nil
+	}
+	slog.Warn("removing stale cgroup", slog.String("path", cg.path))
+	cg.kill()
+	return cg.remove()
+}
+
+// newCgroup creates the cgroup of a run in a box whose id the caller
+// holds. One left over from an earlier run of the box, that failed to be
+// removed, is replaced.
+func newCgroup(root string, name string, constraints isolate.RuntimeConstraints) (*cgroup, error) {
+	if err := removeStaleCgroup(root, name); err != nil {
+		return nil, err
+	}
+	cg := &cgroup{path: filepath.Join(root, name)}
+	if err := os.Mkdir(cg.path, 0755); err != nil {
+		return nil, err
+	}
+
+	pids := "max"
+	if constraints.MaxProcesses > 0 {
+		pids = strconv.Itoa(constraints.MaxProcesses + initTasks)
+	}
+	limits := []struct {
+		file  string
+		value string
+	}{
+		{"memory.max", strconv.FormatInt(int64(constraints.MemoryLimitInKB)*1024, 10)},
+		{"memory.swap.max", "0"},
+		{"pids.max", pids},
+		// a single cpu worth of time per period
+		{"cpu.max", "100000 100000"},
+	}
+	for _, limit := range limits {
+		err := cg.write(limit.file, limit.value)
+		if errors.Is(err, fs.ErrNotExist) && limit.file == "memory.swap.max" {
+			// swap accounting is disabled on the host
+			continue
+		}
+		if err != nil {
+			cg.remove()
+			return nil, fmt.Errorf("setting %s: %w", limit.file, err)
+		}
+	}
+	return cg, nil
+}
+
+func (cg *cgroup) write(file string, value string) error {
+	return os.WriteFile(filepath.Join(cg.path, file), []byte(value), 0)
+}
+
+func (cg *cgroup) addProcess(pid int) error {
+	return cg.write("cgroup.procs", strconv.Itoa(pid))
+}
+
+// readKey reads "key value" lines such as those of cpu.stat.
+func (cg *cgroup) readKey(file string, key string) (int64, error) {
+	f, err := os.Open(filepath.Join(cg.path, file))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[0] == key {
+			return strconv.ParseInt(fields[1], 10, 64)
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return 0, err
+	}
+	return 0, fmt.Errorf("%s has no %s", file, key)
+}
+
+func (cg *cgroup) cpuUsage() (time.Duration, error) {
+	usec, err := cg.readKey("cpu.stat", "usage_usec")
+	return time.Duration(usec) * time.Microsecond, err
+}
+
+// memoryPeakKb needs linux 5.19 or newer, it returns -1 when unavailable.
+func (cg *cgroup) memoryPeakKb() int64 {
+	content, err := os.ReadFile(filepath.Join(cg.path, "memory.peak"))
+	if err != nil {
+		return -1
+	}
+	bytes, err := strconv.ParseInt(strings.TrimSpace(string(content)), 10, 64)
+	if err != nil {
+		return -1
+	}
+	return bytes / 1024
+}
+
+func (cg *cgroup) oomKilled() bool {
+	count, err := cg.readKey("memory.events", "oom_kill")
+	return err == nil && count > 0
+}
+
+// kill kills every process in the cgroup.
+func (cg *cgroup) kill() {
+	if cg.write("cgroup.kill", "1") == nil {
+		return
+	}
+	// cgroup.kill needs linux 5.14
+	content, err := os.ReadFile(filepath.Join(cg.path, "cgroup.procs"))
+	if err != nil {
+		return
+	}
+	for _, line := range strings.Fields(string(content)) {
+		if pid, err := strconv.Atoi(line); err == nil {
+			syscall.Kill(pid, syscall.SIGKILL)
+		}
+	}
+}
+
+// remove deletes the cgroup once the killed processes are gone.
+func (cg *cgroup) remove() error {
+	var err error
+	for i := 0; i < 50; i++ {
+		err = syscall.Rmdir(cg.path)
+		if err == nil || errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if !errors.Is(err, syscall.EBUSY) {
+			return err
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return err
+}
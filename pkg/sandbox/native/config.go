@@ -0,0 +1,46 @@
+// Package native is a sandbox.Sandbox that doesn't need the isolate
+// binary. Every command runs in fresh user, mount, PID, network, IPC and
+// UTS namespaces with a minimal read-only root filesystem, as an
+// unprivileged user, and its memory, process count and CPU usage are
+// limited through a dedicated cgroup v2 subtree.
+//
+// The runner binary doubles as the sandbox init process: main must call
+// MaybeRunInit before doing anything else.
+package native
+
+import (
+	"os"
+	"path/filepath"
+)
+
+type Config struct {
+	// Root holds the box directories, Root/<id>/box is mounted at /box.
+	Root string
+	// CgroupRoot is the cgroup v2 directory the per run cgroups are
+	// created in. It must be on a cgroup2 filesystem.
+	CgroupRoot string
+	// MinBoxId and MaxBoxId bound (inclusively) the box ids in use.
+	MinBoxId int
+	MaxBoxId int
+	// LockDir holds the per box id lock files, see isolate.TryLockBoxId.
+	// Every runner on the host must use the same directory for ids to be
+	// allocated safely.
+	LockDir string
+	// UidBase is the first host uid given to sandboxes. Box n uses
+	// UidBase+2n for the namespace root and UidBase+2n+1 for the program.
+	UidBase int
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Root:       "/var/local/lib/runner-native",
+		CgroupRoot: "/sys/fs/cgroup/runner-native",
+		MinBoxId:   0,
+		MaxBoxId:   999,
+		LockDir:    filepath.Join(os.TempDir(), "runner-native", "locks"),
+		UidBase:    70000,
+	}
+}
+
+// sandboxUid is the uid and gid the program runs as inside the namespace.
+const sandboxUid = 1000
@@ -0,0 +1,370 @@
+//go:build linux
+
+package native
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"syscall"
+	"unsafe"
+
+	"github.com/programme-lv/runner/pkg/isolate"
+)
+
+// initEnv marks the runner binary re-executed as a sandbox init process.
+const initEnv = "RUNNER_NATIVE_INIT"
+
+// File descriptors the init process gets from the runner.
+const (
+	configFd = 3 + iota
+	syncFd
+	resultFd
+)
+
+const prSetNoNewPrivs = 38
+
+// initConfig is sent to the init process over configFd.
+type initConfig struct {
+	Argv        []string
+	Env         []string
+	BoxDir      string
+	RootDir     string
+	Dirs        []isolate.DirRule
+	Constraints isolate.RuntimeConstraints
+	Cpus        []int
+}
+
+// initResult is sent back over resultFd once the command exits or the
+// init fails to start it.
+type initResult struct {
+	Error      string             `json:",omitempty"`
+	WaitStatus syscall.WaitStatus `json:",omitempty"`
+}
+
+// defaultDirs mirror the directories isolate makes available by default.
+var defaultDirs = []isolate.DirRule{
+	{Inside: "/bin", Maybe: true},
+	{Inside: "/lib", Maybe: true},
+	{Inside: "/lib64", Maybe: true},
+	{Inside: "/usr"},
+	{Inside: "/tmp", Tmp: true},
+}
+
+// devices are bound into the otherwise empty /dev.
+var devices = []string{"null", "zero", "full", "random", "urandom"}
+
+// MaybeRunInit turns the process into the init of a sandbox if the native
+// backend started it as one. It never returns in that case.
+//
+// The init stays around as PID 1 of the sandbox and runs the command as
+// its child, since PID 1 is immune to the signals a program might send
+// itself.
+func MaybeRunInit() {
+	if os.Getenv(initEnv) != "1" {
+		return
+	}
+	runtime.LockOSThread()
+
+	var result initResult
+	status, err := runInit()
+	if err != nil {
+		result.Error = fmt.Sprintf("native sandbox init: %v", err)
+	} else {
+		result.WaitStatus = status
+	}
+	json.NewEncoder(os.NewFile(resultFd, "result")).Encode(result)
+	os.Exit(0)
+}
+
+func runInit() (syscall.WaitStatus, error) {
+	for _, fd := range []int{configFd, syncFd, resultFd} {
+		syscall.CloseOnExec(fd)
+	}
+
+	var config initConfig
+	err := json.NewDecoder(os.NewFile(configFd, "config")).Decode(&config)
+	if err != nil {
+		return 0, fmt.Errorf("reading config: %w", err)
+	}
+
+	// the runner has to put us into the cgroup before anything runs
+	buf := make([]byte, 1)
+	if _, err = os.NewFile(syncFd, "sync").Read(buf); err != nil {
+		return 0, fmt.Errorf("waiting for the runner: %w", err)
+	}
+
+	if err = syscall.Sethostname([]byte("box")); err != nil {
+		return 0, err
+	}
+	if err = setupFilesystem(config); err != nil {
+		return 0, err
+	}
+	if err = setRlimits(config.Constraints); err != nil {
+		return 0, err
+	}
+	if err = setAffinity(config.Cpus); err != nil {
+		return 0, err
+	}
+	_, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prSetNoNewPrivs, 1, 0)
+	if errno != 0 {
+		return 0, fmt.Errorf("setting no_new_privs: %w", errno)
+	}
+
+	// leaving uid 0 drops every capability the command had in the namespace
+	cmd := exec.Command("/usr/bin/env", config.Argv...)
+	cmd.Env = config.Env
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Credential: &syscall.Credential{Uid: sandboxUid, Gid: sandboxUid, Groups: []uint32{}},
+	}
+	if err = cmd.Start(); err != nil {
+		return 0, err
+	}
+	// the status is all that matters, a failure is reported through it
+	cmd.Wait()
+	status, _ := cmd.ProcessState.Sys().(syscall.WaitStatus)
+	return status, nil
+}
+
+// setupFilesystem builds the root of the sandbox on a tmpfs, binds the
+// allowed directories into it read-only and the box read-write, and
+// pivots into it.
+func setupFilesystem(config initConfig) error {
+	err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, "")
+	if err != nil {
+		return fmt.Errorf("making mounts private: %w", err)
+	}
+
+	root := config.RootDir
+	err = syscall.Mount("tmpfs", root, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, "mode=0755")
+	if err != nil {
+		return fmt.Errorf("mounting root tmpfs: %w", err)
+	}
+
+	rules := append(append([]isolate.DirRule(nil), defaultDirs...), config.Dirs...)
+	rules = append(rules, isolate.DirRule{Inside: "/box", Outside: config.BoxDir, ReadWrite: true})
+	for _, rule := range rules {
+		if err = mountDirRule(root, rule); err != nil {
+			return fmt.Errorf("dir rule %s: %w", rule.Inside, err)
+		}
+	}
+
+	if err = os.Mkdir(filepath.Join(root, "proc"), 0755); err != nil {
+		return err
+	}
+	err = syscall.Mount("proc", filepath.Join(root, "proc"), "proc",
+		syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, "")
+	if err != nil {
+		return fmt.Errorf("mounting /proc: %w", err)
+	}
+	if err = setupDevices(root); err != nil {
+		return err
+	}
+
+	oldRoot := filepath.Join(root, ".oldroot")
+	if err = os.Mkdir(oldRoot, 0700); err != nil {
+		return err
+	}
+	if err = syscall.PivotRoot(root, oldRoot); err != nil {
+		return fmt.Errorf("pivot_root: %w", err)
+	}
+	if err = syscall.Chdir("/"); err != nil {
+		return err
+	}
+	if err = syscall.Unmount("/.oldroot", syscall.MNT_DETACH); err != nil {
+		return fmt.Errorf("unmounting old root: %w", err)
+	}
+	if err = os.Remove("/.oldroot"); err != nil {
+		return err
+	}
+	err = syscall.Mount("", "/", "", syscall.MS_REMOUNT|syscall.MS_BIND|syscall.MS_RDONLY|
+		syscall.MS_NOSUID|syscall.MS_NODEV, "")
+	if err != nil {
+		return fmt.Errorf("making root read-only: %w", err)
+	}
+	return syscall.Chdir("/box")
+}
+
+func mountDirRule(root string, rule isolate.DirRule) error {
+	target := filepath.Join(root, rule.Inside)
+
+	var flags uintptr = syscall.MS_NOSUID
+	if !rule.Dev {
+		flags |= syscall.MS_NODEV
+	}
+	if rule.NoExec {
+		flags |= syscall.MS_NOEXEC
+	}
+
+	switch {
+	case rule.Tmp:
+		if err := os.MkdirAll(target, 0755); err != nil {
+			return err
+		}
+		return syscall.Mount("tmpfs", target, "tmpfs", flags, "mode=1777")
+	case rule.Fs:
+		if err := os.MkdirAll(target, 0755); err != nil {
+			return err
+		}
+		return syscall.Mount(rule.Outside, target, rule.Outside, flags, "")
+	}
+
+	source := rule.Outside
+	if source == "" {
+		source = rule.Inside
+	}
+	if _, err := os.Stat(source); err != nil {
+		if rule.Maybe && errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	if err := os.MkdirAll(target, 0755); err != nil {
+		return err
+	}
+
+	bindFlags := uintptr(syscall.MS_BIND)
+	if !rule.NoRec {
+		bindFlags |= syscall.MS_REC
+	}
+	if err := syscall.Mount(source, target, "", bindFlags, ""); err != nil {
+		return err
+	}
+
+	// the flags of a bind mount can only be changed by a remount, which
+	// inside a user namespace must keep the flags locked by the source
+	if !rule.ReadWrite {
+		flags |= syscall.MS_RDONLY
+	}
+	flags |= lockedMountFlags(source)
+	return syscall.Mount("", target, "", syscall.MS_REMOUNT|syscall.MS_BIND|flags, "")
+}
+
+// lockedMountFlags returns the mount flags of the filesystem path is on.
+func lockedMountFlags(path string) uintptr {
+	var stat syscall.Statfs_t
+	if syscall.Statfs(path, &stat) != nil {
+		return 0
+	}
+	statFlags := []struct {
+		st    int64
+		mount uintptr
+	}{
+		{1, syscall.MS_RDONLY},
+		{2, syscall.MS_NOSUID},
+		{4, syscall.MS_NODEV},
+		{8, syscall.MS_NOEXEC},
+		{1024, syscall.MS_NOATIME},
+		{2048, syscall.MS_NODIRATIME},
+		{4096, syscall.MS_RELATIME},
+	}
+	var flags uintptr
+	for _, flag := range statFlags {
+		if int64(stat.Flags)&flag.st != 0 {
+			flags |= flag.mount
+		}
+	}
+	return flags
+}
+
+// setupDevices creates /dev with just the harmless character devices,
+// bound from the host as device nodes can't be created in a user namespace.
+func setupDevices(root string) error {
+	dev := filepath.Join(root, "dev")
+	if err := os.Mkdir(dev, 0755); err != nil {
+		return err
+	}
+	err := syscall.Mount("tmpfs", dev, "tmpfs", syscall.MS_NOSUID|syscall.MS_NOEXEC, "mode=0755")
+	if err != nil {
+		return fmt.Errorf("mounting /dev: %w", err)
+	}
+	for _, name := range devices {
+		target := filepath.Join(dev, name)
+		if err = os.WriteFile(target, nil, 0666); err != nil {
+			return err
+		}
+		err = syscall.Mount(filepath.Join("/dev", name), target, "", syscall.MS_BIND, "")
+		if err != nil {
+			return fmt.Errorf("binding /dev/%s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+type rlimit struct {
+	resource int
+	soft     uint64
+	hard     uint64
+}
+
+func setRlimits(constraints isolate.RuntimeConstraints) error {
+	const unlimited = math.MaxUint64
+	kb := func(value int) uint64 {
+		if value <= 0 {
+			return unlimited
+		}
+		return uint64(value) * 1024
+	}
+
+	cpuSec := uint64(math.Ceil(constraints.CpuTimeLimInSec + constraints.ExtraCpuTimeLimInSec))
+	limits := []rlimit{
+		// SIGXCPU first, SIGKILL a second later
+		{syscall.RLIMIT_CPU, cpuSec, cpuSec + 1},
+		{syscall.RLIMIT_FSIZE, kb(constraints.FileSizeLimitInKB), kb(constraints.FileSizeLimitInKB)},
+		{syscall.RLIMIT_STACK, kb(constraints.StackLimitInKB), kb(constraints.StackLimitInKB)},
+		{syscall.RLIMIT_CORE, uint64(constraints.CoreFileSizeInKB) * 1024, uint64(constraints.CoreFileSizeInKB) * 1024},
+	}
+	if constraints.MaxOpenFiles > 0 {
+		files := uint64(constraints.MaxOpenFiles)
+		limits = append(limits, rlimit{syscall.RLIMIT_NOFILE, files, files})
+	}
+
+	for _, limit := range limits {
+		// hard limits can't be raised from inside a user namespace
+		var current syscall.Rlimit
+		if err := syscall.Getrlimit(limit.resource, &current); err != nil {
+			return err
+		}
+		value := syscall.Rlimit{Cur: limit.soft, Max: limit.hard}
+		if value.Max > current.Max {
+			value.Max = current.Max
+		}
+		if value.Cur > value.Max {
+			value.Cur = value.Max
+		}
+		if err := syscall.Setrlimit(limit.resource, &value); err != nil {
+			return fmt.Errorf("setting rlimit %d: %w", limit.resource, err)
+		}
+	}
+	return nil
+}
+
+// setAffinity pins the locked init thread, and so the command it starts,
+// to cpus. None leaves the affinity alone.
+func setAffinity(cpus []int) error {
+	if len(cpus) == 0 {
+		return nil
+	}
+	var mask [16]uint64
+	for _, cpu := range cpus {
+		if cpu >= len(mask)*64 {
+			return fmt.Errorf("cpu %d out of range", cpu)
+		}
+		mask[cpu/64] |= 1 << (cpu % 64)
+	}
+	_, _, errno := syscall.RawSyscall(syscall.SYS_SCHED_SETAFFINITY, 0,
+		unsafe.Sizeof(mask), uintptr(unsafe.Pointer(&mask)))
+	if errno != 0 {
+		return fmt.Errorf("pinning to cpus %s: %w", isolate.CpuList(cpus), errno)
+	}
+	return nil
+}
@@ -0,0 +1,156 @@
+//go:build linux
+
+package native
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	"github.com/programme-lv/runner/pkg/isolate"
+	"github.com/programme-lv/runner/pkg/sandbox"
+	"golang.org/x/exp/slog"
+)
+
+type Sandbox struct {
+	config   Config
+	mutex    sync.Mutex
+	idsInUse map[int]*isolate.BoxLock
+}
+
+// NewSandbox prepares the box root and the cgroup subtree. It needs root
+// privileges, just like isolate does.
+func NewSandbox(config Config) (sandbox.Sandbox, error) {
+	if os.Geteuid() != 0 {
+		return nil, errors.New("the native sandbox must run as root")
+	}
+	if config.MinBoxId < 0 || config.MaxBoxId < config.MinBoxId {
+		return nil, fmt.Errorf("invalid box id range %d-%d", config.MinBoxId, config.MaxBoxId)
+	}
+	if err := setupCgroupRoot(config.CgroupRoot); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(config.Root, 0755); err != nil {
+		return nil, err
+	}
+
+	slog.Info("created native sandbox",
+		slog.String("root", config.Root),
+		slog.String("cgroup-root", config.CgroupRoot))
+
+	return &Sandbox{
+		config:   config,
+		idsInUse: make(map[int]*isolate.BoxLock),
+	}, nil
+}
+
+func (s *Sandbox) NewBox() (sandbox.Box, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	boxId, lock, err := s.claimBoxId()
+	if err != nil {
+		return nil, err
+	}
+
+	box := &Box{sandbox: s, id: boxId}
+	path := filepath.Join(s.config.Root, strconv.Itoa(boxId))
+
+	// with the id locked, whatever is left in the box directory or its
+	// cgroup belongs to a crashed runner
+	err = os.RemoveAll(path)
+	if err == nil {
+		err = removeStaleCgroup(s.config.CgroupRoot, box.cgroupName())
+	}
+	for _, dir := range []string{"box", "root"} {
+		if err == nil {
+			err = os.MkdirAll(filepath.Join(path, dir), 0755)
+		}
+	}
+	if err == nil {
+		err = os.Chown(filepath.Join(path, "box"), box.hostUid(), box.hostUid())
+	}
+	if err != nil {
+		lock.Release()
+		return nil, err
+	}
+
+	s.idsInUse[boxId] = lock
+	box.IsolateBox = isolate.NewIsolateBox(nil, boxId, path)
+	return box, nil
+}
+
+// claimBoxId finds a box id in the configured range that neither this
+// nor any other runner process holds and locks it. Must be called with
+// the mutex held.
+func (s *Sandbox) claimBoxId() (int, *isolate.BoxLock, error) {
+	for boxId := s.config.MinBoxId; boxId <= s.config.MaxBoxId; boxId++ {
+		if s.idsInUse[boxId] != nil {
+			continue
+		}
+		lock, stalePid, err := isolate.TryLockBoxId(s.config.LockDir, boxId)
+		if err != nil {
+			return 0, nil, err
+		}
+		if lock == nil {
+			continue
+		}
+		if stalePid != 0 {
+			slog.Warn("recovering box id abandoned by a crashed process",
+				slog.Int("box-id", boxId), slog.Int("pid", stalePid))
+		}
+		return boxId, lock, nil
+	}
+	return 0, nil, fmt.Errorf("no free box id in range %d-%d",
+		s.config.MinBoxId, s.config.MaxBoxId)
+}
+
+// Box reuses the file operations of isolate boxes, which only depend on
+// the <path>/box layout.
+type Box struct {
+	*isolate.IsolateBox
+	sandbox *Sandbox
+	id      int
+}
+
+// hostUid is the host uid the sandboxed program runs as, the namespace
+// root is mapped to the uid right below it.
+func (box *Box) hostUid() int {
+	return box.sandbox.config.UidBase + 2*box.id + 1
+}
+
+// cgroupName is the cgroup the box's runs get under the cgroup root.
+func (box *Box) cgroupName() string {
+	return "box-" + strconv.Itoa(box.id)
+}
+
+func (box *Box) Run(ctx context.Context, command string, stdin io.ReadCloser,
+	options *isolate.RunOptions) (sandbox.Process, error) {
+	opts, err := isolate.PrepareRunOptions(options)
+	if err != nil {
+		return nil, err
+	}
+	return box.start(ctx, command, stdin, opts)
+}
+
+func (box *Box) Close() error {
+	err := os.RemoveAll(box.Path())
+
+	box.sandbox.mutex.Lock()
+	defer box.sandbox.mutex.Unlock()
+	lock := box.sandbox.idsInUse[box.id]
+	delete(box.sandbox.idsInUse, box.id)
+	if lock != nil {
+		if releaseErr := lock.Release(); err == nil {
+			err = releaseErr
+		}
+	}
+	return err
+}
+
+var _ sandbox.Box = (*Box)(nil)
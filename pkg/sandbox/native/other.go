@@ -0,0 +1,15 @@
+//go:build !linux
+
+package native
+
+import (
+	"errors"
+
+	"github.com/programme-lv/runner/pkg/sandbox"
+)
+
+func NewSandbox(config Config) (sandbox.Sandbox, error) {
+	return nil, errors.New("the native sandbox is only supported on linux")
+}
+
+func MaybeRunInit() {}
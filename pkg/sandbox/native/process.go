@@ -0,0 +1,363 @@
+//go:build linux
+
+package native
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/programme-lv/runner/pkg/isolate"
+	"github.com/programme-lv/runner/pkg/sandbox"
+	"golang.org/x/exp/slog"
+)
+
+// monitorInterval is how often the cpu and wall time of a run are checked.
+const monitorInterval = 10 * time.Millisecond
+
+type process struct {
+	cmd         *exec.Cmd
+	cgroup      *cgroup
+	constraints isolate.RuntimeConstraints
+	env         []string
+	boxId       int
+
+	stdin      io.ReadCloser
+	stdout     io.ReadCloser
+	stderr     io.ReadCloser
+	resultPipe *os.File
+
+	cancel context.CancelFunc
+	start  time.Time
+	// exited is closed once the init was reaped, waitErr is what cmd.Wait
+	// returned and end when that happened.
+	exited  chan struct{}
+	waitErr error
+	end     time.Time
+
+	// mutex orders the monitor's kills against the exit, timedOut and
+	// cancelled are only set when a kill stopped a live command.
+	mutex     sync.Mutex
+	timedOut  bool
+	cancelled bool
+}
+
+func (box *Box) start(ctx context.Context, command string, stdin io.ReadCloser,
+	options isolate.RunOptions) (sandbox.Process, error) {
+	argv, err := isolate.SplitCommand(command)
+	if err != nil {
+		return nil, err
+	}
+	if options.Env.FullEnv {
+		return nil, errors.New("the native sandbox doesn't support full_env")
+	}
+	env := isolate.DefaultEnvironment().Merge(options.Env).Resolve()
+
+	cg, err := newCgroup(box.sandbox.config.CgroupRoot, box.cgroupName(), *options.Constraints)
+	if err != nil {
+		return nil, fmt.Errorf("creating cgroup: %w", err)
+	}
+
+	config := initConfig{
+		Argv:        argv,
+		Env:         env,
+		BoxDir:      filepath.Join(box.Path(), "box"),
+		RootDir:     filepath.Join(box.Path(), "root"),
+		Dirs:        options.Dirs,
+		Constraints: *options.Constraints,
+		Cpus:        options.Cpus,
+	}
+	process := &process{
+		cgroup:      cg,
+		constraints: *options.Constraints,
+		env:         env,
+		boxId:       box.id,
+		exited:      make(chan struct{}),
+	}
+
+	err = process.startInit(box, config, stdin)
+	if err != nil {
+		cg.kill()
+		cg.remove()
+		return nil, err
+	}
+
+	go func() {
+		process.waitErr = process.cmd.Wait()
+		process.mutex.Lock()
+		process.end = time.Now()
+		close(process.exited)
+		process.mutex.Unlock()
+	}()
+
+	ctx, process.cancel = context.WithCancel(ctx)
+	go process.monitor(ctx)
+	return process, nil
+}
+
+// startInit starts the sandbox init, moves it into the cgroup and only
+// then lets it go on to set up the sandbox and exec the command.
+func (process *process) startInit(box *Box, config initConfig,
+	stdin io.ReadCloser) (err error) {
+	var pipes []*os.File
+	defer func() {
+		for _, pipe := range pipes {
+			pipe.Close()
+		}
+	}()
+	newPipe := func() (r *os.File, w *os.File) {
+		if err == nil {
+			r, w, err = os.Pipe()
+			pipes = append(pipes, r, w)
+		}
+		return r, w
+	}
+	configRead, configWrite := newPipe()
+	syncRead, syncWrite := newPipe()
+	resultRead, resultWrite := newPipe()
+	// plain pipes rather than cmd.StdoutPipe, whose read ends cmd.Wait
+	// closes, so that the exit can be waited for while output is read
+	stdoutRead, stdoutWrite := newPipe()
+	stderrRead, stderrWrite := newPipe()
+	if err != nil {
+		return err
+	}
+
+	rootUid := box.sandbox.config.UidBase + 2*box.id
+	cmd := exec.Command("/proc/self/exe")
+	// a single P keeps the thread count of the init low
+	cmd.Env = []string{initEnv + "=1", "GOMAXPROCS=1"}
+	cmd.ExtraFiles = []*os.File{configRead, syncRead, resultWrite}
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags: syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS | syscall.CLONE_NEWPID |
+			syscall.CLONE_NEWNET | syscall.CLONE_NEWIPC | syscall.CLONE_NEWUTS,
+		UidMappings: []syscall.SysProcIDMap{
+			{ContainerID: 0, HostID: rootUid, Size: 1},
+			{ContainerID: sandboxUid, HostID: rootUid + 1, Size: 1},
+		},
+		GidMappings: []syscall.SysProcIDMap{
+			{ContainerID: 0, HostID: rootUid, Size: 1},
+			{ContainerID: sandboxUid, HostID: rootUid + 1, Size: 1},
+		},
+		GidMappingsEnableSetgroups: true,
+		// keeps the capabilities in the new namespace across the exec
+		Credential: &syscall.Credential{Uid: 0, Gid: 0},
+		Pdeathsig:  syscall.SIGKILL,
+	}
+
+	var stdinPipe io.WriteCloser
+	if stdin != nil {
+		stdinPipe, err = cmd.StdinPipe()
+		if err != nil {
+			return err
+		}
+	}
+	cmd.Stdout, cmd.Stderr = stdoutWrite, stderrWrite
+	if err = cmd.Start(); err != nil {
+		return err
+	}
+	process.cmd = cmd
+	process.start = time.Now()
+
+	// from here on the init is waiting for us and has to be reaped
+	fail := func(err error) error {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return err
+	}
+	if err = process.cgroup.addProcess(cmd.Process.Pid); err != nil {
+		return fail(fmt.Errorf("adding process to cgroup: %w", err))
+	}
+	if err = json.NewEncoder(configWrite).Encode(config); err != nil {
+		return fail(fmt.Errorf("sending config: %w", err))
+	}
+	if _, err = syncWrite.Write([]byte{0}); err != nil {
+		return fail(fmt.Errorf("starting init: %w", err))
+	}
+
+	if stdin != nil {
+		process.stdin = stdin
+		go isolate.CopyStdin(stdinPipe, stdin)
+	}
+
+	// keep the read ends of the output and result pipes, the init writes
+	// its result last
+	pipes = []*os.File{configRead, configWrite, syncRead, syncWrite, resultWrite,
+		stdoutWrite, stderrWrite}
+	process.stdout, process.stderr = stdoutRead, stderrRead
+	process.resultPipe = resultRead
+	return nil
+}
+
+// monitor enforces the time limits and kills the run once ctx is done.
+// It stops as soon as the command exits, whether or not Wait was called.
+func (process *process) monitor(ctx context.Context) {
+	cpuLimit := time.Duration((process.constraints.CpuTimeLimInSec +
+		process.constraints.ExtraCpuTimeLimInSec) * float64(time.Second))
+	wallLimit := time.Duration(process.constraints.WallTimeLimInSec * float64(time.Second))
+
+	ticker := time.NewTicker(monitorInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-process.exited:
+			return
+		case <-ctx.Done():
+			if process.stop(&process.cancelled) {
+				slog.Info("killing cancelled native command", slog.Int("box-id", process.boxId))
+			}
+			return
+		case <-ticker.C:
+		}
+
+		usage, err := process.cgroup.cpuUsage()
+		if (err == nil && usage > cpuLimit) || time.Since(process.start) > wallLimit {
+			process.stop(&process.timedOut)
+			return
+		}
+	}
+}
+
+// stop kills the run and sets reason unless the command already exited,
+// telling whether it did.
+func (process *process) stop(reason *bool) bool {
+	process.mutex.Lock()
+	defer process.mutex.Unlock()
+	select {
+	case <-process.exited:
+		return false
+	default:
+	}
+	*reason = true
+	process.cgroup.kill()
+	return true
+}
+
+func (process *process) Kill() {
+	process.cancel()
+}
+
+func (process *process) Stdout() io.ReadCloser {
+	return process.stdout
+}
+
+func (process *process) Stderr() io.ReadCloser {
+	return process.stderr
+}
+
+// Wait blocks until the command exits and returns metrics in the same
+// shape isolate reports them in.
+func (process *process) Wait() (*isolate.IsolateMetrics, error) {
+	// nothing is sent if the init itself was killed
+	var result initResult
+	resultErr := json.NewDecoder(process.resultPipe).Decode(&result)
+	process.resultPipe.Close()
+
+	<-process.exited
+	waitErr := process.waitErr
+	wall := process.end.Sub(process.start)
+	process.cancel()
+	process.stdout.Close()
+	process.stderr.Close()
+	if process.stdin != nil {
+		process.stdin.Close()
+	}
+
+	// the init was the only process outside of the command, anything
+	// still in the cgroup is an orphan of the command
+	process.cgroup.kill()
+	defer func() {
+		if err := process.cgroup.remove(); err != nil {
+			slog.Warn("failed to remove cgroup", slog.String("path", process.cgroup.path),
+				slog.String("error", err.Error()))
+		}
+	}()
+
+	var exitErr *exec.ExitError
+	if waitErr != nil && !errors.As(waitErr, &exitErr) {
+		return nil, waitErr
+	}
+
+	process.mutex.Lock()
+	timedOut, cancelled := process.timedOut, process.cancelled
+	process.mutex.Unlock()
+
+	metrics := &isolate.IsolateMetrics{
+		TimeWallSec: wall.Seconds(),
+		CgEnabled:   true,
+		CgOomKilled: process.cgroup.oomKilled(),
+		Env:         process.env,
+		Cancelled:   cancelled,
+	}
+	state := process.cmd.ProcessState
+	metrics.TimeSec = (state.UserTime() + state.SystemTime()).Seconds()
+	if usage, err := process.cgroup.cpuUsage(); err == nil {
+		metrics.TimeSec = usage.Seconds()
+	}
+	if usage, ok := state.SysUsage().(*syscall.Rusage); ok {
+		metrics.MaxRssKb = usage.Maxrss
+		metrics.CswVoluntary = usage.Nvcsw
+		metrics.CswForced = usage.Nivcsw
+	}
+	metrics.CgMemKb = process.cgroup.memoryPeakKb()
+	if metrics.CgMemKb < 0 {
+		metrics.CgMemKb = metrics.MaxRssKb
+	}
+
+	status, _ := state.Sys().(syscall.WaitStatus)
+	if resultErr == nil {
+		status = result.WaitStatus
+	}
+	switch {
+	case result.Error != "":
+		metrics.Status = "XX"
+		metrics.Message = result.Error
+	case timedOut:
+		metrics.Status = "TO"
+		metrics.Killed = true
+		if time.Duration(metrics.TimeSec*float64(time.Second)) > time.Duration(
+			process.constraints.CpuTimeLimInSec*float64(time.Second)) {
+			metrics.Message = "Time limit exceeded"
+		} else {
+			metrics.Message = "Time limit exceeded (wall clock)"
+		}
+	case status.Signaled():
+		metrics.Status = "SG"
+		metrics.Killed = cancelled || metrics.CgOomKilled
+		metrics.ExitSig = int64(status.Signal())
+		metrics.Message = fmt.Sprintf("Caught fatal signal %d", status.Signal())
+		if status.Signal() == syscall.SIGXCPU {
+			metrics.Status = "TO"
+			metrics.Message = "Time limit exceeded"
+		}
+	case status.ExitStatus() != 0:
+		metrics.Status = "RE"
+		metrics.ExitCode = int64(status.ExitStatus())
+		metrics.Message = fmt.Sprintf("Exited with error status %d", status.ExitStatus())
+	}
+
+	slog.Info("native metrics",
+		slog.Int("box-id", process.boxId),
+		slog.Float64("time", metrics.TimeSec),
+		slog.Float64("time-wall", metrics.TimeWallSec),
+		slog.Int64("max-rss", metrics.MaxRssKb),
+		slog.Int64("cg-mem", metrics.CgMemKb),
+		slog.Bool("cg-oom-killed", metrics.CgOomKilled),
+		slog.Int64("exitcode", metrics.ExitCode),
+		slog.Int64("exitsig", metrics.ExitSig),
+		slog.String("status", metrics.Status),
+		slog.String("message", metrics.Message),
+		slog.String("verdict", string(metrics.Verdict())))
+
+	return metrics, nil
+}
+
+var _ sandbox.Process = (*process)(nil)
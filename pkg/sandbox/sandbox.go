@@ -0,0 +1,41 @@
+// Package sandbox describes what the runner needs from a sandbox, so that
+// it can be backed by isolate in production and by a fake in tests.
+package sandbox
+
+import (
+	"context"
+	"io"
+	"io/fs"
+
+	"github.com/programme-lv/runner/pkg/isolate"
+)
+
+type Sandbox interface {
+	NewBox() (Box, error)
+}
+
+type Box interface {
+	Id() int
+	Path() string
+
+	AddFile(path string, content []byte) error
+	AddFileWithMode(path string, content []byte, mode fs.FileMode) error
+	ReadFile(path string) ([]byte, error)
+	ListFiles() ([]isolate.BoxFile, error)
+	RemoveFile(path string) error
+
+	// Run starts command. Input is forwarded from stdin as it arrives, nil
+	// means no input; stdin is closed once the command exits.
+	Run(ctx context.Context, command string, stdin io.ReadCloser,
+		options *isolate.RunOptions) (Process, error)
+
+	// Close releases the box and everything in it.
+	Close() error
+}
+
+type Process interface {
+	Stdout() io.ReadCloser
+	Stderr() io.ReadCloser
+	Wait() (*isolate.IsolateMetrics, error)
+	Kill()
+}